@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/sync/errgroup"
@@ -12,6 +14,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -21,18 +25,100 @@ import (
 const (
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
 	powerDNSZonePathEnvKey         = "ISUCON13_POWERDNS_ZONE_PATH"
+	dnsTTLEnvKey                   = "ISUCON13_DNS_TTL"
+	isuDNSTokenEnvKey              = "ISUCON13_ISUDNS_TOKEN"
+
+	isuDNSTokenHeader = "X-Isudns-Token"
+
+	healthCheckTimeout = 1 * time.Second
+
+	defaultDNSTTL = 30
 )
 
 var (
 	powerDNSSubdomainAddress string
 	powerDNSZonePath         string
+	dnsTTL                   = defaultDNSTTL
+	isuDNSToken              string
 	dbConn                   *sqlx.DB
 )
 
+// 名前 -> アドレス
+// ゾーンの再読み込み時は新しいMapを作ってポインタごと差し替え、読み込み途中の状態が見えないようにする
 var (
-	records = sync.Map{}
+	records atomic.Pointer[sync.Map]
+	// APIによる追加・削除は共有ロック、再読み込みは排他ロックを取り、差し替え中の書き込みが失われないようにする
+	recordsWriteMtx sync.RWMutex
 )
 
+func init() {
+	records.Store(&sync.Map{})
+}
+
+func storeRecord(name, addr string) {
+	recordsWriteMtx.RLock()
+	defer recordsWriteMtx.RUnlock()
+	records.Load().Store(name, addr)
+}
+
+func deleteRecord(name string) {
+	recordsWriteMtx.RLock()
+	defer recordsWriteMtx.RUnlock()
+	records.Load().Delete(name)
+}
+
+// 完全一致するレコードを優先し、なければ近い順にワイルドカード (*.<親ドメイン>) を探す
+func lookupRecord(name string) (string, bool) {
+	m := records.Load()
+	if addr, ok := m.Load(name); ok {
+		return addr.(string), true
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		wildcard := "*." + strings.Join(labels[i:], ".") + "."
+		if addr, ok := m.Load(wildcard); ok {
+			return addr.(string), true
+		}
+	}
+	return "", false
+}
+
+func recordName(param RecordCreateParam) string {
+	if param.Wildcard {
+		return fmt.Sprintf("*.%s.u.isucon.dev.", param.Username)
+	}
+	return fmt.Sprintf("%s.u.isucon.dev.", param.Username)
+}
+
+// DNSクエリの統計 (起動時からの累計。読み出してもリセットしない)
+var queryStats struct {
+	byType   sync.Map // クエリタイプ名 -> *atomic.Int64
+	answered atomic.Int64
+	nxdomain atomic.Int64
+	noAnswer atomic.Int64
+}
+
+func countQueryType(qtype uint16) {
+	name := "OTHER"
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeSOA, dns.TypeNS:
+		name = dns.TypeToString[qtype]
+	}
+	v, _ := queryStats.byType.LoadOrStore(name, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+}
+
+func countQueryResult(m *dns.Msg) {
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		queryStats.nxdomain.Add(1)
+	case len(m.Answer) > 0:
+		queryStats.answered.Add(1)
+	default:
+		queryStats.noAnswer.Add(1)
+	}
+}
+
 //
 //var records = map[string]string{
 //	"test.u.isucon.dev.": "192.168.0.2",
@@ -47,6 +133,13 @@ func connectDB() (*sqlx.DB, error) {
 		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
 		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+
+		connectAttemptsEnvKey = "ISUCON13_MYSQL_CONNECT_ATTEMPTS"
+		connectBackoffEnvKey  = "ISUCON13_MYSQL_CONNECT_BACKOFF_MS"
+
+		maxOpenConnsEnvKey    = "ISUCON13_DB_MAX_OPEN"
+		maxIdleConnsEnvKey    = "ISUCON13_DB_MAX_IDLE"
+		connMaxLifetimeEnvKey = "ISUCON13_DB_CONN_MAX_LIFETIME_SEC"
 	)
 
 	conf := mysql.NewConfig()
@@ -91,28 +184,84 @@ func connectDB() (*sqlx.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(10)
-
-	if err := db.Ping(); err != nil {
-		return nil, err
+	// MySQLの再起動後に切れた接続を使い続けないよう、接続は一定時間で作り直す
+	// アイドル接続数は環境変数が指定された場合のみ変更する
+	maxOpenConns, maxIdleConns, connMaxLifetime := 10, -1, 5*time.Minute
+	if v, ok := os.LookupEnv(maxOpenConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", maxOpenConnsEnvKey, v)
+		}
+		maxOpenConns = n
+	}
+	if v, ok := os.LookupEnv(maxIdleConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", maxIdleConnsEnvKey, v)
+		}
+		maxIdleConns = n
+	}
+	if v, ok := os.LookupEnv(connMaxLifetimeEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", connMaxLifetimeEnvKey, v)
+		}
+		connMaxLifetime = time.Duration(sec) * time.Second
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	if maxIdleConns >= 0 {
+		db.SetMaxIdleConns(maxIdleConns)
+	}
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	// DBの起動が遅れても落ちないよう、一定回数までPingをリトライする
+	attempts, backoff := 10, 1*time.Second
+	if v, ok := os.LookupEnv(connectAttemptsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("environment variable '%s' must be positive integer: %s", connectAttemptsEnvKey, v)
+		}
+		attempts = n
+	}
+	if v, ok := os.LookupEnv(connectBackoffEnvKey); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", connectBackoffEnvKey, v)
+		}
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	for i := 1; ; i++ {
+		err := db.Ping()
+		if err == nil {
+			break
+		}
+		if i >= attempts {
+			db.Close()
+			return nil, err
+		}
+		log.Printf("failed to ping db (attempt %d/%d), retrying in %s: %v", i, attempts, backoff, err)
+		time.Sleep(backoff)
 	}
 
 	return db, nil
 }
 
-func parseQuery(m *dns.Msg, db sqlx.DB) {
+// dbは起動時に接続できなかった場合nilになる
+// DBを使う問い合わせを追加する場合は、nilや接続エラー時にerrorを返すこと
+func parseQuery(m *dns.Msg, db *sqlx.DB) error {
 	for _, q := range m.Question {
 		log.Printf("Query for %s (type: %s)\n", q.Name, dns.TypeToString[q.Qtype])
+		countQueryType(q.Qtype)
 		switch q.Qtype {
 		case dns.TypeSOA:
-			rr, err := dns.NewRR(fmt.Sprintf("%s SOA %s %s 0 10800 3600 604800 3600", q.Name, "ns1 hostmaster.u.isucon.dev.", "isucon.isucon.net."))
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN SOA %s %s 0 10800 3600 604800 3600", q.Name, dnsTTL, "ns1.u.isucon.dev.", "hostmaster.u.isucon.dev."))
 			if err != nil {
 				log.Printf("Failed to create SOA record: %s\n", err.Error())
 				continue
 			}
 			m.Answer = append(m.Answer, rr)
 		case dns.TypeNS:
-			rr, err := dns.NewRR(fmt.Sprintf("%s NS %s", q.Name, "ns1.u.isucon.dev."))
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN NS %s", q.Name, dnsTTL, "ns1.u.isucon.dev."))
 			if err != nil {
 				log.Printf("Failed to create NS record: %s\n", err.Error())
 				continue
@@ -120,14 +269,14 @@ func parseQuery(m *dns.Msg, db sqlx.DB) {
 			m.Answer = append(m.Answer, rr)
 		case dns.TypeA:
 			log.Printf("Query for %s\n", q.Name)
-			_, ok := records.Load(q.Name)
+			_, ok := lookupRecord(q.Name)
 			if ok {
-				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, powerDNSSubdomainAddress))
+				rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", q.Name, dnsTTL, powerDNSSubdomainAddress))
 				if err == nil {
 					m.Answer = append(m.Answer, rr)
 				}
 			} else {
-				rr, err := dns.NewRR(fmt.Sprintf("%s A", q.Name))
+				rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A", q.Name, dnsTTL))
 				if err != nil {
 					log.Printf("Failed to create NXDOMAIN record: %s\n", err.Error())
 					continue
@@ -138,6 +287,7 @@ func parseQuery(m *dns.Msg, db sqlx.DB) {
 			}
 		}
 	}
+	return nil
 }
 
 func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
@@ -147,14 +297,41 @@ func handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		parseQuery(m, *dbConn)
+		if err := safeParseQuery(m, dbConn); err != nil {
+			log.Printf("Failed to handle query: %s\n", err.Error())
+			m = new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+		}
+		countQueryResult(m)
 	}
 
 	w.WriteMsg(m)
 }
 
+// 問い合わせの処理中にpanicしてもサーバごと落ちないよう、SERVFAILとして応答する
+func safeParseQuery(m *dns.Msg, db *sqlx.DB) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while handling query: %v", r)
+		}
+	}()
+	return parseQuery(m, db)
+}
+
+// ISUCON13_ISUDNS_TOKEN が設定されている場合のみ X-Isudns-Token ヘッダを検証する
+func authorize(w http.ResponseWriter, r *http.Request) error {
+	if isuDNSToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(isuDNSTokenHeader)), []byte(isuDNSToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return fmt.Errorf("invalid %s header", isuDNSTokenHeader)
+	}
+	return nil
+}
+
 type RecordCreateParam struct {
 	Username string `json:"username"`
+	// trueなら *.<username>.u.isucon.dev. を登録・削除する
+	Wildcard bool `json:"wildcard"`
 }
 
 func HandleAddRecord(w http.ResponseWriter, r *http.Request) error {
@@ -165,6 +342,10 @@ func HandleAddRecord(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("method not allowed")
 	}
 
+	if err := authorize(w, r); err != nil {
+		return err
+	}
+
 	param := RecordCreateParam{}
 	if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -172,13 +353,154 @@ func HandleAddRecord(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("failed to decode request body: %w", err)
 	}
 
-	records.Store(fmt.Sprintf("%s.u.isucon.dev.", param.Username), powerDNSSubdomainAddress)
+	storeRecord(recordName(param), powerDNSSubdomainAddress)
 	w.WriteHeader(http.StatusCreated)
-	log.Printf("Created record for %s\n", param.Username)
+	log.Printf("Created record %s\n", recordName(param))
+	return nil
+}
+
+// 登録に失敗したユーザのレコードを取り消すために使う
+func HandleDeleteRecord(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return fmt.Errorf("method not allowed")
+	}
+
+	if err := authorize(w, r); err != nil {
+		return err
+	}
+
+	param := RecordCreateParam{}
+	if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("failed to decode request body"))
+		return fmt.Errorf("failed to decode request body: %w", err)
+	}
+
+	deleteRecord(recordName(param))
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("Deleted record %s\n", recordName(param))
+	return nil
+}
+
+type HealthResult struct {
+	Status string `json:"status"`
+}
+
+func HandleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return fmt.Errorf("method not allowed")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	if dbConn == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(HealthResult{Status: "db_unavailable"})
+		return fmt.Errorf("db is not connected")
+	}
+	if err := dbConn.PingContext(ctx); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(HealthResult{Status: "db_unavailable"})
+		return fmt.Errorf("failed to ping db: %w", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(HealthResult{Status: "ok"})
+	return nil
+}
+
+type StatsResult struct {
+	// クエリタイプ (A, AAAA, SOA, NS, OTHER) ごとの件数
+	Queries map[string]int64 `json:"queries"`
+	// 応答結果ごとの件数
+	Answered int64 `json:"answered"`
+	NXDomain int64 `json:"nxdomain"`
+	NoAnswer int64 `json:"no_answer"`
+}
+
+// 起動時からの累計を返す
+func HandleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return fmt.Errorf("method not allowed")
+	}
+
+	result := StatsResult{
+		Queries:  map[string]int64{},
+		Answered: queryStats.answered.Load(),
+		NXDomain: queryStats.nxdomain.Load(),
+		NoAnswer: queryStats.noAnswer.Load(),
+	}
+	queryStats.byType.Range(func(key, value any) bool {
+		result.Queries[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
 	return nil
 }
 
-func loadZoneFile(zoneFilePath string) error {
+type ReloadResult struct {
+	Records int `json:"records"`
+}
+
+func HandleReload(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return fmt.Errorf("method not allowed")
+	}
+
+	if err := authorize(w, r); err != nil {
+		return err
+	}
+
+	n, err := loadZoneFile(powerDNSZonePath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return fmt.Errorf("failed to reload zone file: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ReloadResult{Records: n})
+	log.Printf("Reloaded %d records from %s\n", n, powerDNSZonePath)
+	return nil
+}
+
+// ゾーンファイルを読み込んで records にマージする
+// APIで動的に追加されたレコードは残したまま、パースに成功した場合のみ反映する
+func loadZoneFile(zoneFilePath string) (int, error) {
+	zone, err := parseZoneFile(zoneFilePath)
+	if err != nil {
+		return 0, err
+	}
+
+	recordsWriteMtx.Lock()
+	defer recordsWriteMtx.Unlock()
+
+	next := &sync.Map{}
+	records.Load().Range(func(name, addr any) bool {
+		next.Store(name, addr)
+		return true
+	})
+	for name, addr := range zone {
+		next.Store(name, addr)
+	}
+	records.Store(next)
+	return len(zone), nil
+}
+
+func parseZoneFile(zoneFilePath string) (map[string]string, error) {
 	// example
 	// ns1      0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
 	//pipe     0 IN A  <ISUCON_SUBDOMAIN_ADDRESS>
@@ -186,30 +508,74 @@ func loadZoneFile(zoneFilePath string) error {
 
 	f, err := os.Open(zoneFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to open zone file: %w", err)
+		return nil, fmt.Errorf("failed to open zone file: %w", err)
 	}
 	defer f.Close()
 	body, err := io.ReadAll(f)
 	if err != nil {
-		return fmt.Errorf("failed to read zone file: %w", err)
+		return nil, fmt.Errorf("failed to read zone file: %w", err)
 	}
 
-	for _, line := range strings.Split(string(body), "\n") {
-		if line == "" {
+	zone := make(map[string]string)
+
+	// SOAなど括弧で複数行にまたがるレコードの中かどうか
+	inParens := false
+	for i, line := range strings.Split(string(body), "\n") {
+		lineNo := i + 1
+		if idx := strings.Index(line, ";"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if inParens {
+			if strings.Contains(line, ")") {
+				inParens = false
+			}
+			continue
+		}
+		if strings.HasPrefix(fields[0], "$") {
+			// $TTL, $ORIGIN などのディレクティブ
+			continue
+		}
+		if strings.Contains(line, "(") {
+			inParens = !strings.Contains(line, ")")
+			continue
+		}
+
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("invalid zone file format at line %d: expected 5 fields but got %d (line: %q)", lineNo, len(fields), line)
+		}
+		if _, err := strconv.ParseUint(fields[1], 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid zone file format at line %d: invalid TTL %q", lineNo, fields[1])
+		}
+		if fields[2] != "IN" {
+			return nil, fmt.Errorf("invalid zone file format at line %d: unsupported class %q", lineNo, fields[2])
+		}
+		switch fields[3] {
+		case "A":
+		case "NS", "SOA":
+			// NS, SOAは応答時に生成するので読み込まない
 			continue
+		default:
+			return nil, fmt.Errorf("invalid zone file format at line %d: unsupported record type %q (line: %q)", lineNo, fields[3], line)
 		}
-		if strings.Contains(line, "0 IN A") {
-			s := strings.Split(line, " ")
-			//if len(s) != 5 {
-			//	fmt.Println(len(s))
-			//	return fmt.Errorf("invalid zone file format (line: %s)", line)
-			//}
-			fmt.Println()
-			records.Store(fmt.Sprintf("%s.u.isucon.dev.", s[0]), powerDNSSubdomainAddress)
+		if _, ok := dns.IsDomainName(fields[0]); !ok {
+			return nil, fmt.Errorf("invalid zone file format at line %d: invalid name %q", lineNo, fields[0])
 		}
+
+		name := fmt.Sprintf("%s.u.isucon.dev.", fields[0])
+		if fields[0] == "@" {
+			name = "u.isucon.dev."
+		}
+		zone[name] = powerDNSSubdomainAddress
+	}
+	if inParens {
+		return nil, fmt.Errorf("invalid zone file format: unterminated parenthesis")
 	}
 
-	return nil
+	return zone, nil
 }
 
 func main() {
@@ -222,21 +588,37 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	if v, ok := os.LookupEnv(dnsTTLEnvKey); ok {
+		ttl, err := strconv.Atoi(v)
+		if err != nil || ttl < 0 {
+			log.Fatalf("environ %s must be a non-negative integer: %s", dnsTTLEnvKey, v)
+		}
+		dnsTTL = ttl
+	}
+
+	if token, ok := os.LookupEnv(isuDNSTokenEnvKey); ok && token != "" {
+		isuDNSToken = token
+	} else {
+		log.Printf("WARNING: environ %s is not set, /api/record accepts unauthenticated requests\n", isuDNSTokenEnvKey)
+	}
+
 	zonePath, ok := os.LookupEnv(powerDNSZonePathEnvKey)
 	if !ok {
 		log.Fatalf("environ %s must be provided", powerDNSZonePathEnvKey)
 	}
 	powerDNSZonePath = zonePath
-	if err := loadZoneFile(powerDNSZonePath); err != nil {
+	if _, err := loadZoneFile(powerDNSZonePath); err != nil {
 		log.Fatalf("failed to load zone file: %s", err.Error())
 	}
 
+	// レコードはメモリ上にあるので、DBに接続できなくても応答は続ける
 	db, err := connectDB()
 	if err != nil {
-		log.Fatalf("Failed to connect DB: %s\n", err.Error())
+		log.Printf("WARNING: failed to connect DB, serving in-memory records only: %s\n", err.Error())
+	} else {
+		defer db.Close()
+		dbConn = db
 	}
-	defer db.Close()
-	dbConn = db
 
 	eg := errgroup.Group{}
 
@@ -255,7 +637,26 @@ func main() {
 	eg.Go(func() error {
 		// start http server
 		http.HandleFunc("/api/record", func(w http.ResponseWriter, r *http.Request) {
-			if err := HandleAddRecord(w, r); err != nil {
+			handle := HandleAddRecord
+			if r.Method == http.MethodDelete {
+				handle = HandleDeleteRecord
+			}
+			if err := handle(w, r); err != nil {
+				log.Printf("Failed to handle request: %s\n", err.Error())
+			}
+		})
+		http.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+			if err := HandleHealth(w, r); err != nil {
+				log.Printf("Failed to handle request: %s\n", err.Error())
+			}
+		})
+		http.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+			if err := HandleStats(w, r); err != nil {
+				log.Printf("Failed to handle request: %s\n", err.Error())
+			}
+		})
+		http.HandleFunc("/api/reload", func(w http.ResponseWriter, r *http.Request) {
+			if err := HandleReload(w, r); err != nil {
 				log.Printf("Failed to handle request: %s\n", err.Error())
 			}
 		})
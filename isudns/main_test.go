@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/miekg/dns"
+)
+
+func writeZoneFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "u.isucon.dev.zone")
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setSubdomainAddress(t *testing.T, addr string) {
+	prev := powerDNSSubdomainAddress
+	powerDNSSubdomainAddress = addr
+	t.Cleanup(func() { powerDNSSubdomainAddress = prev })
+}
+
+func TestParseZoneFile(t *testing.T) {
+	setSubdomainAddress(t, "192.0.2.1")
+	cases := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{
+			name: "tab separated",
+			body: "pipe\t0\tIN\tA\t192.0.2.1\ntest001\t\t0 IN\tA   192.0.2.1\n",
+			want: map[string]string{
+				"pipe.u.isucon.dev.":    "192.0.2.1",
+				"test001.u.isucon.dev.": "192.0.2.1",
+			},
+		},
+		{
+			name: "comments",
+			body: "; header comment\n" +
+				"   ; indented comment\n" +
+				"pipe     0 IN A  192.0.2.1 ; trailing comment\n",
+			want: map[string]string{
+				"pipe.u.isucon.dev.": "192.0.2.1",
+			},
+		},
+		{
+			name: "directives, SOA and NS",
+			body: "$TTL 3600\n" +
+				"@   SOA  ns1 hostmaster.u.isucon.dev. (\n" +
+				"    0      ; serial\n" +
+				"    3600   ; ncache\n" +
+				")\n" +
+				"@        0 IN NS ns1.u.isucon.dev.\n" +
+				"@        0 IN A  192.0.2.1\n",
+			want: map[string]string{
+				"u.isucon.dev.": "192.0.2.1",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseZoneFile(writeZoneFile(t, tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("records = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseZoneFileInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"missing fields", "pipe 0 IN A 192.0.2.1\nbroken 0 IN A\n", "line 2"},
+		{"invalid TTL", "pipe x IN A 192.0.2.1\n", "invalid TTL"},
+		{"unsupported class", "pipe 0 CH A 192.0.2.1\n", "unsupported class"},
+		{"unsupported type", "\npipe 0 IN CNAME www.u.isucon.dev.\n", `line 2: unsupported record type "CNAME"`},
+		{"invalid name", "pi..pe 0 IN A 192.0.2.1\n", "invalid name"},
+		{"unterminated parenthesis", "@ SOA ns1 hostmaster.u.isucon.dev. (\n0\n", "unterminated parenthesis"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseZoneFile(writeZoneFile(t, tc.body))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error = %q, want it to contain %q", err.Error(), tc.want)
+			}
+		})
+	}
+}
+
+// 応答を記録する dns.ResponseWriter
+type recordingResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func resetRecords(t *testing.T) {
+	prev := records.Load()
+	records.Store(&sync.Map{})
+	t.Cleanup(func() { records.Store(prev) })
+}
+
+func query(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	w := &recordingResponseWriter{}
+	handleDnsRequest(w, r)
+	if w.msg == nil {
+		t.Fatal("no response written")
+	}
+	return w.msg
+}
+
+func TestQueryTTL(t *testing.T) {
+	resetRecords(t)
+	setSubdomainAddress(t, "192.0.2.1")
+	prev := dnsTTL
+	dnsTTL = 120
+	t.Cleanup(func() { dnsTTL = prev })
+	storeRecord("pipe.u.isucon.dev.", "192.0.2.1")
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeSOA, dns.TypeNS} {
+		m := query(t, "pipe.u.isucon.dev.", qtype)
+		if len(m.Answer) != 1 {
+			t.Fatalf("%s: got %d answers, want 1", dns.TypeToString[qtype], len(m.Answer))
+		}
+		if ttl := m.Answer[0].Header().Ttl; ttl != 120 {
+			t.Errorf("%s: ttl = %d, want 120", dns.TypeToString[qtype], ttl)
+		}
+	}
+}
+
+func TestQueryWildcard(t *testing.T) {
+	resetRecords(t)
+	setSubdomainAddress(t, "192.0.2.1")
+
+	// APIでワイルドカードのレコードを追加する
+	for _, body := range []string{`{"username":"pipe","wildcard":true}`, `{"username":"exact.pipe"}`} {
+		w := httptest.NewRecorder()
+		if err := HandleAddRecord(w, httptest.NewRequest(http.MethodPost, "/api/record", strings.NewReader(body))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		rcode int
+	}{
+		{"a.pipe.u.isucon.dev.", dns.RcodeSuccess},
+		{"a.b.pipe.u.isucon.dev.", dns.RcodeSuccess},
+		{"exact.pipe.u.isucon.dev.", dns.RcodeSuccess},
+		// ワイルドカードは親ドメイン自身にはマッチしない
+		{"pipe.u.isucon.dev.", dns.RcodeNameError},
+		{"a.other.u.isucon.dev.", dns.RcodeNameError},
+	}
+	for _, tc := range cases {
+		m := query(t, tc.name, dns.TypeA)
+		if m.Rcode != tc.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tc.name, dns.RcodeToString[m.Rcode], dns.RcodeToString[tc.rcode])
+		}
+	}
+}
+
+func TestLookupRecordPrefersExactMatch(t *testing.T) {
+	resetRecords(t)
+	storeRecord("*.pipe.u.isucon.dev.", "192.0.2.1")
+	storeRecord("exact.pipe.u.isucon.dev.", "192.0.2.2")
+
+	if addr, ok := lookupRecord("exact.pipe.u.isucon.dev."); !ok || addr != "192.0.2.2" {
+		t.Errorf("exact lookup = %q, %v, want 192.0.2.2", addr, ok)
+	}
+	if addr, ok := lookupRecord("other.pipe.u.isucon.dev."); !ok || addr != "192.0.2.1" {
+		t.Errorf("wildcard lookup = %q, %v, want 192.0.2.1", addr, ok)
+	}
+}
+
+func TestQueryWithoutDB(t *testing.T) {
+	resetRecords(t)
+	setSubdomainAddress(t, "192.0.2.1")
+	storeRecord("pipe.u.isucon.dev.", "192.0.2.1")
+
+	closed, err := sqlx.Open("mysql", "isucon:isucon@tcp(127.0.0.1:1)/isupipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	prev := dbConn
+	t.Cleanup(func() { dbConn = prev })
+	for name, db := range map[string]*sqlx.DB{"nil": nil, "closed": closed} {
+		dbConn = db
+		// レコードはメモリ上にあるので、DBが使えなくても応答できる
+		m := query(t, "pipe.u.isucon.dev.", dns.TypeA)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+			t.Errorf("%s db: rcode = %s, answers = %d", name, dns.RcodeToString[m.Rcode], len(m.Answer))
+		}
+
+		w := httptest.NewRecorder()
+		if err := HandleHealth(w, httptest.NewRequest(http.MethodGet, "/api/health", nil)); err == nil {
+			t.Errorf("%s db: health check succeeded", name)
+		}
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s db: health status = %d, want %d", name, w.Code, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestSafeParseQueryRecoversPanic(t *testing.T) {
+	// 処理中にpanicしてもエラーとして返し、handleDnsRequestがSERVFAILで応答する
+	if err := safeParseQuery(nil, nil); err == nil {
+		t.Error("safeParseQuery did not report the panic")
+	}
+}
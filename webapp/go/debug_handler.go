@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ProfileResponse struct {
+	Path string `json:"path"`
+}
+
+// CPUプロファイル開始API
+// POST /api/debug/profile/start
+func startProfileHandler(c echo.Context) error {
+	path, _, err := StartProfile()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to start profile: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &ProfileResponse{
+		Path: path,
+	})
+}
+
+// CPUプロファイル停止API
+// POST /api/debug/profile/stop
+func stopProfileHandler(c echo.Context) error {
+	path := StopProfile()
+	if path == "" {
+		return echo.NewHTTPError(http.StatusConflict, "profile is not running")
+	}
+
+	return c.JSON(http.StatusOK, &ProfileResponse{
+		Path: path,
+	})
+}
+
+type RecomputedUserCounters struct {
+	ID           int64  `json:"id" db:"id"`
+	Name         string `json:"name" db:"name"`
+	Reactions    int64  `json:"reactions" db:"reactions"`
+	Tips         int64  `json:"tips" db:"tips"`
+	LiveComments int64  `json:"live_comments" db:"live_comments"`
+}
+
+// 1ユーザ分の集計値を再計算するAPI
+// POST /api/admin/recompute/user/:username
+func recomputeUserCountersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	if err := tx.GetContext(ctx, &userID, "SELECT id FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, recomputeUserCountersQuery+" WHERE u.id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user counters: "+err.Error())
+	}
+
+	var counters RecomputedUserCounters
+	if err := tx.GetContext(ctx, &counters, "SELECT id, name, reactions, tips, live_comments FROM users WHERE id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user counters: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	userCache.Delete(fmt.Sprintf("id:%d", counters.ID))
+	userCache.Delete(fmt.Sprintf("name:%s", counters.Name))
+	invalidateRankingCache()
+
+	return c.JSON(http.StatusOK, &counters)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// クライアントがエラーの種類で分岐できるように、ErrorResponse.Code に入れる機械可読なコード
+const (
+	errCodeValidationFailed     = "VALIDATION_FAILED"
+	errCodeUnauthorized         = "UNAUTHORIZED"
+	errCodeSessionExpired       = "SESSION_EXPIRED"
+	errCodeForbidden            = "FORBIDDEN"
+	errCodeNotFound             = "NOT_FOUND"
+	errCodeConflict             = "CONFLICT"
+	errCodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	errCodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	errCodeTooManyRequests      = "TOO_MANY_REQUESTS"
+	errCodeInternal             = "INTERNAL_ERROR"
+	errCodeUnknown              = "UNKNOWN_ERROR"
+
+	// ステータスコードだけでは区別できない個別の失敗
+	errCodeUsernameTaken   = "USERNAME_TAKEN"
+	errCodeAlreadyReported = "ALREADY_REPORTED"
+	errCodeSlotUnavailable = "SLOT_UNAVAILABLE"
+)
+
+// ハンドラが個別のコードを指定しなかった場合に使う、ステータスコードごとの既定値
+var defaultErrorCodes = map[int]string{
+	http.StatusBadRequest:            errCodeValidationFailed,
+	http.StatusUnauthorized:          errCodeUnauthorized,
+	http.StatusForbidden:             errCodeForbidden,
+	http.StatusNotFound:              errCodeNotFound,
+	http.StatusConflict:              errCodeConflict,
+	http.StatusRequestEntityTooLarge: errCodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  errCodeUnsupportedMediaType,
+	http.StatusTooManyRequests:       errCodeTooManyRequests,
+	http.StatusInternalServerError:   errCodeInternal,
+}
+
+func errorCodeForStatus(status int) string {
+	if code, ok := defaultErrorCodes[status]; ok {
+		return code
+	}
+	return errCodeUnknown
+}
+
+// コード付きのHTTPエラー
+// errorResponseHandler で ErrorResponse.Code として返される
+type codedHTTPError struct {
+	*echo.HTTPError
+	code string
+	// バリデーションエラーの場合に、問題のあるフィールド
+	fields []FieldError
+	// 予約できなかった場合に、埋まっていた予約枠
+	unavailableSlots []ReservationSlotRange
+}
+
+func (e *codedHTTPError) Unwrap() error {
+	return e.HTTPError
+}
+
+func newCodedHTTPError(status int, code string, message string) error {
+	return &codedHTTPError{
+		HTTPError: echo.NewHTTPError(status, message),
+		code:      code,
+	}
+}
+
+// フィールドごとのエラーを ErrorResponse.Fields として返すバリデーションエラー
+func newValidationError(message string, fields []FieldError) error {
+	return &codedHTTPError{
+		HTTPError: echo.NewHTTPError(http.StatusBadRequest, message),
+		code:      errCodeValidationFailed,
+		fields:    fields,
+	}
+}
+
+// 埋まっていた予約枠を ErrorResponse.UnavailableSlots として返すエラー
+func newSlotUnavailableError(message string, slots []ReservationSlotRange) error {
+	return &codedHTTPError{
+		HTTPError:        echo.NewHTTPError(http.StatusBadRequest, message),
+		code:             errCodeSlotUnavailable,
+		unavailableSlots: slots,
+	}
+}
+
+// エラーからステータスコードとエラーコードを取り出す
+func resolveErrorCode(err error) (int, string) {
+	var ce *codedHTTPError
+	if errors.As(err, &ce) {
+		return ce.Code, ce.code
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code, errorCodeForStatus(he.Code)
+	}
+	return http.StatusInternalServerError, errCodeInternal
+}
+
+// エラーからステータスコードとレスポンスボディを組み立てる
+func newErrorResponse(err error) (int, *ErrorResponse) {
+	status, code := resolveErrorCode(err)
+	res := &ErrorResponse{Error: err.Error(), Code: code}
+	var ce *codedHTTPError
+	if errors.As(err, &ce) {
+		res.Fields = ce.fields
+		res.UnavailableSlots = ce.unavailableSlots
+	}
+	return status, res
+}
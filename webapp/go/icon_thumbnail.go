@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hlts2/gocache"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// 埋め込むアイコンはこの大きさに収まるよう縮小する
+	iconThumbnailSize    = 64
+	iconThumbnailQuality = 80
+)
+
+// アイコンのハッシュをキーに、縮小したアイコンのdata URIを保持する
+// 変換に失敗したものは空文字列を入れて再変換しないようにする
+var iconThumbnailCache = gocache.New(gocache.WithExpireAt(iconCacheTTL()))
+
+// ?embed_icon=true の場合のみ、ユーザ情報にアイコンを埋め込む
+func wantsEmbeddedIcon(c echo.Context) bool {
+	embed, _ := strconv.ParseBool(c.QueryParam("embed_icon"))
+	return embed
+}
+
+// 一覧に埋め込めるアイコンの種類の上限
+// 埋め込みは小さい一覧向けなので、超える場合はlimitを小さくしてもらう
+const (
+	maxEmbeddedIcons      = 50
+	iconThumbnailParallel = 8
+)
+
+// ユーザ情報にアイコンのサムネイルをdata URIとして埋め込む
+// アイコンはDBではなくファイルに保存しているので、同じアイコンは1回だけ読み込み、
+// キャッシュにないものだけを並行して変換する
+func embedUserIcons(users []*User) error {
+	byHash := make(map[string][]*User)
+	for _, user := range users {
+		byHash[user.IconHash] = append(byHash[user.IconHash], user)
+	}
+	if len(byHash) > maxEmbeddedIcons {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("embed_icon is available for lists with up to %d different icons", maxEmbeddedIcons))
+	}
+
+	var eg errgroup.Group
+	eg.SetLimit(iconThumbnailParallel)
+	for hash, users := range byHash {
+		hash, users := hash, users
+		eg.Go(func() error {
+			uri := iconThumbnail(hash)
+			for _, user := range users {
+				user.IconDataURI = uri
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// ライブ配信一覧の配信者にアイコンを埋め込む
+func embedOwnerIcons(livestreams []Livestream) error {
+	owners := make([]*User, len(livestreams))
+	for i := range livestreams {
+		owners[i] = &livestreams[i].Owner
+	}
+	return embedUserIcons(owners)
+}
+
+// 変換に失敗した場合は空文字列を返す
+func iconThumbnail(hash string) string {
+	if v, found := iconThumbnailCache.Get(hash); found {
+		return v.(string)
+	}
+
+	v, _, _ := iconLoadGroup.Do("thumbnail:"+hash, func() (interface{}, error) {
+		uri, err := encodeIconThumbnail(hash)
+		if err != nil {
+			log.Printf("failed to make thumbnail of icon %s: %v", hash, err)
+			uri = ""
+		}
+		iconThumbnailCache.Set(hash, uri)
+		return uri, nil
+	})
+	return v.(string)
+}
+
+func encodeIconThumbnail(hash string) (string, error) {
+	src, err := os.ReadFile(filepath.Join(iconDir, hash))
+	if os.IsNotExist(err) {
+		src, err = os.ReadFile(fallbackImage)
+	}
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, shrinkImage(img, iconThumbnailSize), &jpeg.Options{Quality: iconThumbnailQuality}); err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// 縦横比を保ったまま、長辺がsize以下になるよう最近傍法で縮小する
+func shrinkImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, size
+	if w > h {
+		dh = max(1, h*size/w)
+	} else {
+		dw = max(1, w*size/h)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*w/dw, b.Min.Y+y*h/dh))
+		}
+	}
+	return dst
+}
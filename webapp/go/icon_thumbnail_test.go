@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEmbedUserIconsSharesThumbnails(t *testing.T) {
+	resetCachesForTest()
+	t.Cleanup(resetCachesForTest)
+	iconThumbnailCache.Set("aa", "data:image/jpeg;base64,AA")
+	iconThumbnailCache.Set("bb", "data:image/jpeg;base64,BB")
+
+	users := []*User{{Name: "alice", IconHash: "aa"}, {Name: "bob", IconHash: "bb"}, {Name: "carol", IconHash: "aa"}}
+	if err := embedUserIcons(users); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		want := "data:image/jpeg;base64," + strings.ToUpper(user.IconHash)
+		if user.IconDataURI != want {
+			t.Errorf("%s: icon = %q, want %q", user.Name, user.IconDataURI, want)
+		}
+	}
+}
+
+func TestEmbedUserIconsFallback(t *testing.T) {
+	resetCachesForTest()
+	t.Cleanup(resetCachesForTest)
+
+	// ファイルのないアイコンはデフォルト画像のサムネイルになる
+	users := []*User{{Name: "alice", IconHash: "0000"}}
+	if err := embedUserIcons(users); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(users[0].IconDataURI, "data:image/jpeg;base64,") {
+		t.Fatalf("icon = %q, want jpeg data URI", users[0].IconDataURI)
+	}
+	if v, found := iconThumbnailCache.Get("0000"); !found || v.(string) != users[0].IconDataURI {
+		t.Error("thumbnail is not cached")
+	}
+}
+
+func TestEmbedUserIconsTooMany(t *testing.T) {
+	resetCachesForTest()
+	t.Cleanup(resetCachesForTest)
+
+	users := make([]*User, maxEmbeddedIcons+1)
+	for i := range users {
+		hash := fmt.Sprintf("%04x", i)
+		iconThumbnailCache.Set(hash, "data:image/jpeg;base64,")
+		users[i] = &User{IconHash: hash}
+	}
+	err := embedUserIcons(users)
+	if err == nil {
+		t.Fatalf("embedding %d icons succeeded, want error", len(users))
+	}
+	if got, _ := resolveErrorCode(err); got != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+	}
+	if err := embedUserIcons(users[:maxEmbeddedIcons]); err != nil {
+		t.Errorf("embedding %d icons failed: %v", maxEmbeddedIcons, err)
+	}
+}
+
+func TestShrinkImage(t *testing.T) {
+	cases := []struct {
+		w, h         int
+		wantW, wantH int
+	}{
+		{32, 32, 32, 32},
+		{256, 256, 64, 64},
+		{256, 128, 64, 32},
+		{100, 400, 16, 64},
+	}
+	for _, tc := range cases {
+		got := shrinkImage(image.NewRGBA(image.Rect(0, 0, tc.w, tc.h)), iconThumbnailSize).Bounds()
+		if got.Dx() != tc.wantW || got.Dy() != tc.wantH {
+			t.Errorf("shrink %dx%d = %dx%d, want %dx%d", tc.w, tc.h, got.Dx(), got.Dy(), tc.wantW, tc.wantH)
+		}
+	}
+}
+
+func TestSearchUsersEmbedIcon(t *testing.T) {
+	mock := setupMockDB(t)
+	alice := &UserModel{ID: 1, Name: "alice", IconHash: []byte{0xaa}}
+	alicia := &UserModel{ID: 2, Name: "alicia", IconHash: []byte{0xaa}}
+	cacheUserForTest(alice)
+	cacheUserForTest(alicia)
+	iconThumbnailCache.Set("aa", "data:image/jpeg;base64,AA")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectCommit()
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/search?q=ali&embed_icon=true", nil)
+	withLoginSession(c, 1, "alice")
+	if err := searchUsersHandler(c); err != nil {
+		t.Fatal(err)
+	}
+	var users []User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("got %d users, want 2", len(users))
+	}
+	for _, user := range users {
+		if user.IconDataURI != "data:image/jpeg;base64,AA" {
+			t.Errorf("%s: icon = %q", user.Name, user.IconDataURI)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/hlts2/gocache"
+	"github.com/labstack/echo/v4"
+)
+
+const webpIconQuality = 80
+
+// アイコンのハッシュをキーにWebPへ変換した結果を保持する
+// 変換に失敗したものは空のスライスを入れて再変換しないようにする
+var webpIconCache = gocache.New(gocache.WithExpireAt(iconCacheTTL()))
+
+func acceptsWebP(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get(echo.HeaderAccept), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.TrimSpace(mediaType) == "image/webp" {
+			return true
+		}
+	}
+	return false
+}
+
+// 形式ごとにETagを分けて、条件付きリクエストで別形式の画像を返さないようにする
+func iconETag(iconHash []byte, isWebP bool) string {
+	if isWebP {
+		return fmt.Sprintf("\"%x-webp\"", iconHash)
+	}
+	return fmt.Sprintf("\"%x\"", iconHash)
+}
+
+func loadWebPIcon(user *UserModel) ([]byte, bool) {
+	key := fmt.Sprintf("%x", user.IconHash)
+	if v, found := webpIconCache.Get(key); found {
+		b := v.([]byte)
+		return b, len(b) > 0
+	}
+
+	v, _, _ := iconLoadGroup.Do("webp:"+key, func() (interface{}, error) {
+		b, err := encodeWebPIcon(user)
+		if err != nil {
+			log.Printf("failed to transcode icon %s to webp: %v", key, err)
+			b = []byte{}
+		}
+		webpIconCache.Set(key, b)
+		return b, nil
+	})
+	b := v.([]byte)
+	return b, len(b) > 0
+}
+
+func encodeWebPIcon(user *UserModel) ([]byte, error) {
+	src, err := loadIcon(user)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, &webp.Options{Quality: webpIconQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -3,16 +3,17 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -43,15 +44,35 @@ type LivecommentReport struct {
 	ID          int64       `json:"id"`
 	Reporter    User        `json:"reporter"`
 	Livecomment Livecomment `json:"livecomment"`
+	Reason      string      `json:"reason"`
 	CreatedAt   int64       `json:"created_at"`
 }
 
 type LivecommentReportModel struct {
-	ID            int64 `db:"id"`
-	UserID        int64 `db:"user_id"`
-	LivestreamID  int64 `db:"livestream_id"`
-	LivecommentID int64 `db:"livecomment_id"`
-	CreatedAt     int64 `db:"created_at"`
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	Reason        string `db:"reason"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type PostLivecommentReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+const (
+	reportReasonSpam       = "spam"
+	reportReasonHarassment = "harassment"
+	reportReasonOther      = "other"
+)
+
+func isValidReportReason(reason string) bool {
+	switch reason {
+	case reportReasonSpam, reportReasonHarassment, reportReasonOther:
+		return true
+	}
+	return false
 }
 
 type ModerateRequest struct {
@@ -63,6 +84,7 @@ type NGWord struct {
 	UserID       int64  `json:"user_id" db:"user_id"`
 	LivestreamID int64  `json:"livestream_id" db:"livestream_id"`
 	Word         string `json:"word" db:"word"`
+	BlockedCount int64  `json:"blocked_count" db:"blocked_count"`
 	CreatedAt    int64  `json:"created_at" db:"created_at"`
 }
 
@@ -97,12 +119,36 @@ func getLivecommentsHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to get user id: %w", err)
 	}
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY id DESC"
+	// レスポンスは常に新しい順 (id DESC)
+	//   before_id: それより古いコメントを新しい順に limit 件 (過去に遡るページング)
+	//   after_id:  それより新しいコメントを、古い方から limit 件 (ポーリングでの差分取得)
+	//              取りこぼさないよう、次回は返ってきた最大のidを after_id に指定する
+	where := "livestream_id = ?"
+	params := []interface{}{livestreamID}
+	order := "DESC"
+	if c.QueryParam("before_id") != "" {
+		beforeID, err := strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+		where += " AND id < ?"
+		params = append(params, beforeID)
+	}
+	if c.QueryParam("after_id") != "" {
+		afterID, err := strconv.ParseInt(c.QueryParam("after_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "after_id query parameter must be integer")
+		}
+		where += " AND id > ?"
+		params = append(params, afterID)
+		order = "ASC"
+	}
+	query := "SELECT * FROM livecomments WHERE " + where + " ORDER BY id " + order
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
@@ -112,30 +158,21 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, params...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
-	userIds := make([]int64, len(livecommentModels))
-	for i, model := range livecommentModels {
-		userIds[i] = model.UserID
+	if order == "ASC" {
+		for i, j := 0, len(livecommentModels)-1; i < j; i, j = i+1, j-1 {
+			livecommentModels[i], livecommentModels[j] = livecommentModels[j], livecommentModels[i]
+		}
 	}
-	commentOwners, err := getUsersWithCache(ctx, tx, userIds)
+	livecomments, err := fillLivecommentsResponse(ctx, tx, livecommentModels, &livestreamModel, tagsId, livestreamUser)
 	if err != nil {
-		return fmt.Errorf("failed to get user id: %w", err)
-	}
-
-	livecomments := make([]Livecomment, len(livecommentModels))
-	for i := range livecommentModels {
-		livecomment, err := fillLivecommentResponse(ctx, &livecommentModels[i], &livestreamModel, tagsId, livestreamUser, commentOwners[livecommentModels[i].UserID])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
-		}
-
-		livecomments[i] = livecomment
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -148,15 +185,11 @@ func getLivecommentsHandler(c echo.Context) error {
 func getNgwords(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -169,7 +202,7 @@ func getNgwords(c echo.Context) error {
 	defer tx.Rollback()
 
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC, id DESC", userID, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
@@ -184,11 +217,35 @@ func getNgwords(c echo.Context) error {
 	return c.JSON(http.StatusOK, ngWords)
 }
 
+// NGワードをヒット数の多い順に取得
+// GET /api/livestream/:livestream_id/ngwords/usage
+func getNgwordsUsage(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	ngWords := []*NGWord{}
+	if err := dbConn.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY blocked_count DESC, id DESC", userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ngWords)
+}
+
 func postLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
@@ -197,14 +254,18 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *PostLivecommentRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
+	if strings.TrimSpace(req.Comment) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "comment must not be empty")
+	}
+	if utf8.RuneCountInString(req.Comment) > maxCommentLen {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("comment must be at most %d characters", maxCommentLen))
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -228,8 +289,14 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
+	comment := strings.ToLower(req.Comment)
 	for _, ngword := range ngwords {
-		if strings.Contains(req.Comment, ngword.Word) {
+		// 正規化前に登録されたNGワードもあるので比較時にも正規化する
+		if word := normalizeNGWord(ngword.Word); word != "" && strings.Contains(comment, word) {
+			// 拒否するとトランザクションはロールバックされるので、ヒット数はトランザクション外で数える
+			if _, err := dbConn.ExecContext(ctx, "UPDATE ng_words SET blocked_count = blocked_count + 1 WHERE id = ?", ngword.ID); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update NG word blocked count: "+err.Error())
+			}
 			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 		}
 	}
@@ -256,7 +323,7 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream max_tip count: "+err.Error())
 	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE users SET tips = tips + ? WHERE id = ?", req.Tip, livestreamModel.UserID); err != nil {
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET tips = tips + ?, live_comments = live_comments + 1 WHERE id = ?", req.Tip, livestreamModel.UserID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tips for user: "+err.Error())
 	}
 
@@ -269,8 +336,8 @@ func postLivecommentHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to get user id: %w", err)
 	}
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
 	commentOwner, err := getUserWithCache(ctx, userID)
@@ -286,6 +353,12 @@ func postLivecommentHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	if req.Tip > 0 {
+		paymentCache.Delete(paymentCacheKey)
+		invalidateRankingCache()
+	}
+
+	livecommentHub.publish(livecomment)
 
 	return c.JSON(http.StatusCreated, livecomment)
 }
@@ -293,7 +366,8 @@ func postLivecommentHandler(c echo.Context) error {
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
@@ -307,10 +381,17 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	// 報告理由は省略可能
+	req := PostLivecommentReportRequest{Reason: reportReasonOther}
+	if err := decodeRequestBody(c, &req); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if req.Reason == "" {
+		req.Reason = reportReasonOther
+	}
+	if !isValidReportReason(req.Reason) {
+		return echo.NewHTTPError(http.StatusBadRequest, "reason must be one of spam, harassment, other")
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -327,8 +408,18 @@ func reportLivecommentHandler(c echo.Context) error {
 		}
 	}
 
+	// 同じライブコメントを二重に報告させない
+	var reported int
+	if err := tx.GetContext(ctx, &reported, "SELECT COUNT(*) FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ?", userID, livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to check livecomment report: "+err.Error())
+	}
+	if reported > 0 {
+		return newCodedHTTPError(http.StatusConflict, errCodeAlreadyReported, "already reported this livecomment")
+	}
+
 	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
+	// 別のライブ配信のコメントをこの配信への通報として登録させない
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
 		} else {
@@ -336,8 +427,8 @@ func reportLivecommentHandler(c echo.Context) error {
 		}
 	}
 
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
 	now := time.Now().Unix()
@@ -345,10 +436,16 @@ func reportLivecommentHandler(c echo.Context) error {
 		UserID:        int64(userID),
 		LivestreamID:  int64(livestreamID),
 		LivecommentID: int64(livecommentID),
+		Reason:        req.Reason,
 		CreatedAt:     now,
 	}
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, reason, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :reason, :created_at)", &reportModel)
 	if err != nil {
+		// 同時に通報された場合は、事前の確認をすり抜けて一意制約に当たる
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+			return newCodedHTTPError(http.StatusConflict, errCodeAlreadyReported, "already reported this livecomment")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
 	}
 	reportID, err := rs.LastInsertId()
@@ -380,12 +477,84 @@ func reportLivecommentHandler(c echo.Context) error {
 	return c.JSON(http.StatusCreated, report)
 }
 
+// 配信者がライブコメントを1件削除する
+// DELETE /api/livestream/:livestream_id/livecomment/:livecomment_id
+func deleteLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete livecomments of other streamer's livestream")
+	}
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ? FOR UPDATE", livecommentID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livecomments WHERE id = ?", livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomment: "+err.Error())
+	}
+	// 消えたコメントへの通報が残ると通報一覧を返せなくなるため、一緒に削除する
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livecomment_reports WHERE livecomment_id = ?", livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomment reports: "+err.Error())
+	}
+
+	// 削除したコメントが最高額の投げ銭だった場合に備えて、max_tipは残りのコメントから求め直す
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET tips = tips - ?, max_tip = (SELECT IFNULL(MAX(tip), 0) FROM livecomments WHERE livestream_id = ?) WHERE id = ?", livecommentModel.Tip, livestreamID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tips: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET tips = tips - ?, live_comments = IF(live_comments > 0, live_comments - 1, 0) WHERE id = ?", livecommentModel.Tip, livestreamModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user counters: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	if livecommentModel.Tip > 0 {
+		paymentCache.Delete(paymentCacheKey)
+		invalidateRankingCache()
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 // NGワードを登録
 func moderateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
@@ -394,14 +563,16 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *ModerateRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
+	req.NGWord = normalizeNGWord(req.NGWord)
+	if req.NGWord == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "ng_word must not be empty")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -419,7 +590,8 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
+	// 同じNGワードが登録済みなら、既存のIDを返す
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)", &NGWord{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
 		Word:         req.NGWord,
@@ -435,18 +607,17 @@ func moderateHandler(c echo.Context) error {
 	}
 
 	// NGワードにヒットする過去の投稿も全削除する
-	// ライブコメント一覧取得
+	// 投稿時のスパム判定と同じく、小文字に揃えて部分一致させる
 	var livecomments []*LivecommentModel
-	if err := tx.SelectContext(ctx, &livecomments, "SELECT id, comment FROM livecomments WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT id, tip FROM livecomments WHERE livestream_id = ? AND LOWER(comment) LIKE ? FOR UPDATE", livestreamID, "%"+escapeLike(req.NGWord)+"%"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
-	livecommentIds := make([]int64, 0)
-
+	livecommentIds := make([]int64, 0, len(livecomments))
+	var deletedTips int64
 	for _, livecomment := range livecomments {
-		if strings.Contains(livecomment.Comment, req.NGWord) {
-			livecommentIds = append(livecommentIds, livecomment.ID)
-		}
+		livecommentIds = append(livecommentIds, livecomment.ID)
+		deletedTips += livecomment.Tip
 	}
 	if len(livecommentIds) > 0 {
 		query, params, err := sqlx.In("DELETE FROM livecomments WHERE id IN (?)", livecommentIds)
@@ -456,17 +627,50 @@ func moderateHandler(c echo.Context) error {
 		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomments: "+err.Error())
 		}
+		query, params, err = sqlx.In("DELETE FROM livecomment_reports WHERE livecomment_id IN (?)", livecommentIds)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to create query: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomment reports: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE ng_words SET blocked_count = blocked_count + ? WHERE id = ?", len(livecommentIds), wordID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update NG word blocked count: "+err.Error())
+		}
+
+		// 削除したライブコメントの分だけ集計値を戻す
+		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET tips = tips - ?, max_tip = (SELECT IFNULL(MAX(tip), 0) FROM livecomments WHERE livestream_id = ?) WHERE id = ?", deletedTips, livestreamID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tips: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET tips = tips - ?, live_comments = live_comments - ? WHERE id = ?", deletedTips, len(livecommentIds), userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user counters: "+err.Error())
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	if deletedTips > 0 {
+		paymentCache.Delete(paymentCacheKey)
+		invalidateRankingCache()
+	}
 
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
+		"word_id":              wordID,
+		"deleted_livecomments": len(livecommentIds),
 	})
 }
 
+// NGワードは大文字小文字を区別せずに照合するため、登録時・比較時ともにこの形に揃える
+func normalizeNGWord(word string) string {
+	return strings.ToLower(strings.TrimSpace(word))
+}
+
+// LIKEのワイルドカードとして解釈されないようエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
 func fillLivecommentResponse(ctx context.Context, livecommentModel *LivecommentModel, livestreamModel *LivestreamModel, tagIds []int64, liveOwnerModel *UserModel, commentOwnerModel *UserModel) (Livecomment, error) {
 	commentOwner, err := fillUserResponse(ctx, commentOwnerModel)
 	if err != nil {
@@ -489,6 +693,28 @@ func fillLivecommentResponse(ctx context.Context, livecommentModel *LivecommentM
 	return livecomment, nil
 }
 
+// 同じ配信に対するライブコメントをまとめてレスポンスに変換する
+func fillLivecommentsResponse(ctx context.Context, tx *sqlx.Tx, livecommentModels []LivecommentModel, livestreamModel *LivestreamModel, tagIds []int64, liveOwnerModel *UserModel) ([]Livecomment, error) {
+	userIds := make([]int64, len(livecommentModels))
+	for i, model := range livecommentModels {
+		userIds[i] = model.UserID
+	}
+	commentOwners, err := getUsersWithCache(ctx, tx, userIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user id: %w", err)
+	}
+
+	livecomments := make([]Livecomment, len(livecommentModels))
+	for i := range livecommentModels {
+		livecomment, err := fillLivecommentResponse(ctx, &livecommentModels[i], livestreamModel, tagIds, liveOwnerModel, commentOwners[livecommentModels[i].UserID])
+		if err != nil {
+			return nil, err
+		}
+		livecomments[i] = livecomment
+	}
+	return livecomments, nil
+}
+
 func fillLivecommentReportResponse(ctx context.Context, reportModel *LivecommentReportModel, livecommentModel *LivecommentModel, livestreamModel *LivestreamModel, tagIds []int64, liveOwnerModel *UserModel, commentOwnerModel *UserModel, reporterModel *UserModel) (LivecommentReport, error) {
 	reporter, err := fillUserResponse(ctx, reporterModel)
 	if err != nil {
@@ -504,6 +730,7 @@ func fillLivecommentReportResponse(ctx context.Context, reportModel *Livecomment
 		ID:          reportModel.ID,
 		Reporter:    reporter,
 		Livecomment: livecomment,
+		Reason:      reportModel.Reason,
 		CreatedAt:   reportModel.CreatedAt,
 	}
 	return report, nil
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestModerateRegistersNGWordOnce(t *testing.T) {
+	db := setupTestMySQL(t)
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', '')",
+		"INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, 0)",
+	)
+
+	var wordIDs []int64
+	// 正規化すると同じNGワードになる
+	for _, word := range []string{"spam", " SPAM "} {
+		c, rec := newTestContext(http.MethodPost, "/api/livestream/10/moderate", strings.NewReader(`{"ng_word":"`+word+`"}`))
+		withLoginSession(c, 1, "streamer")
+		withParams(c, "livestream_id", "10")
+		if got := statusOf(moderateHandler(c), rec); got != http.StatusCreated {
+			t.Fatalf("moderate %q: status = %d, want %d", word, got, http.StatusCreated)
+		}
+		var res struct {
+			WordID int64 `json:"word_id"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		wordIDs = append(wordIDs, res.WordID)
+	}
+	if wordIDs[0] != wordIDs[1] {
+		t.Errorf("word_id = %v, want the same id", wordIDs)
+	}
+
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM ng_words WHERE livestream_id = 10"); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("ng_words rows = %d, want 1", count)
+	}
+
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/10/ngwords", nil)
+	withLoginSession(c, 1, "streamer")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(getNgwords(c), rec); got != http.StatusOK {
+		t.Fatalf("getNgwords status = %d, want %d", got, http.StatusOK)
+	}
+	var ngWords []NGWord
+	if err := json.Unmarshal(rec.Body.Bytes(), &ngWords); err != nil {
+		t.Fatal(err)
+	}
+	if len(ngWords) != 1 || ngWords[0].Word != "spam" || ngWords[0].ID != wordIDs[0] {
+		t.Errorf("ng words = %+v, want only spam", ngWords)
+	}
+}
+
+func TestReportLivecommentDuplicate(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(10).
+		WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ?")).
+		WithArgs(2, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/10/livecomment/100/report", strings.NewReader(`{"reason":"spam"}`))
+	withLoginSession(c, 2, "viewer")
+	withParams(c, "livestream_id", "10", "livecomment_id", "100")
+	err := reportLivecommentHandler(c)
+	if got := statusOf(err, rec); got != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", got, http.StatusConflict)
+	}
+	if _, code := resolveErrorCode(err); code != errCodeAlreadyReported {
+		t.Errorf("code = %s, want %s", code, errCodeAlreadyReported)
+	}
+}
+
+// 重複確認をすり抜けた同時の通報も、一意制約から409にする
+func TestReportLivecommentConcurrentDuplicate(t *testing.T) {
+	mock := setupMockDB(t)
+	livestreamTagsCache.Set(livestreamTagsCacheKey(10), []int64{})
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(10).
+		WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ?")).
+		WithArgs(2, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?")).
+		WithArgs(100, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "livestream_id", "comment", "tip", "created_at"}).AddRow(100, 3, 10, "spam", 0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO livecomment_reports")).
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry '2-100' for key 'livecomment_reports.uniq_user_livecomment'"})
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/10/livecomment/100/report", strings.NewReader(`{"reason":"spam"}`))
+	withLoginSession(c, 2, "viewer")
+	withParams(c, "livestream_id", "10", "livecomment_id", "100")
+	err := reportLivecommentHandler(c)
+	if got := statusOf(err, rec); got != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", got, http.StatusConflict)
+	}
+	if _, code := resolveErrorCode(err); code != errCodeAlreadyReported {
+		t.Errorf("code = %s, want %s", code, errCodeAlreadyReported)
+	}
+}
+
+// 別のライブ配信のコメントは通報できない
+func TestReportLivecommentOfOtherLivestream(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(10).
+		WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM livecomment_reports WHERE user_id = ? AND livecomment_id = ?")).
+		WithArgs(2, 200).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?")).
+		WithArgs(200, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "livestream_id", "comment", "tip", "created_at"}))
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/10/livecomment/200/report", strings.NewReader(`{"reason":"spam"}`))
+	withLoginSession(c, 2, "viewer")
+	withParams(c, "livestream_id", "10", "livecomment_id", "200")
+	if got := statusOf(reportLivecommentHandler(c), rec); got != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestReportLivecommentInvalidReason(t *testing.T) {
+	// 理由の検証はDBを引く前に行う
+	setupMockDB(t)
+	for _, body := range []string{`{"reason":"boring"}`, `{"reason":"SPAM"}`} {
+		c, rec := newTestContext(http.MethodPost, "/api/livestream/10/livecomment/100/report", strings.NewReader(body))
+		withLoginSession(c, 2, "viewer")
+		withParams(c, "livestream_id", "10", "livecomment_id", "100")
+		if got := statusOf(reportLivecommentHandler(c), rec); got != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, got, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPostLivecommentLength(t *testing.T) {
+	cases := []struct {
+		name    string
+		comment string
+		valid   bool
+	}{
+		{"max length", strings.Repeat("あ", maxCommentLen), true},
+		{"too long", strings.Repeat("あ", maxCommentLen+1), false},
+		{"ascii max length", strings.Repeat("a", maxCommentLen), true},
+		{"empty", "", false},
+		{"whitespace only", " \t\n　", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			want := http.StatusBadRequest
+			if tc.valid {
+				// 長さの検証を通ればライブ配信を引きに行く
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+					WithArgs(10).
+					WillReturnRows(livestreamRows())
+				mock.ExpectRollback()
+				want = http.StatusNotFound
+			}
+
+			body, err := json.Marshal(&PostLivecommentRequest{Comment: tc.comment})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, rec := newTestContext(http.MethodPost, "/api/livestream/10/livecomment", bytes.NewReader(body))
+			withLoginSession(c, 2, "viewer")
+			withParams(c, "livestream_id", "10")
+			if got := statusOf(postLivecommentHandler(c), rec); got != want {
+				t.Errorf("status = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// 大文字小文字の違いや前後の文字があってもNGワードにヒットする
+var ngWordVariants = []string{"SPAM", "spam!", "xspamx"}
+
+func TestPostLivecommentNGWordVariants(t *testing.T) {
+	for _, comment := range ngWordVariants {
+		t.Run(comment, func(t *testing.T) {
+			mock := setupMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+				WithArgs(10).
+				WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+			mock.ExpectQuery(regexp.QuoteMeta("FROM ng_words WHERE user_id = ? AND livestream_id = ?")).
+				WithArgs(1, 10).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "livestream_id", "word"}).AddRow(5, 1, 10, "spam"))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE ng_words SET blocked_count = blocked_count + 1 WHERE id = ?")).
+				WithArgs(5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectRollback()
+
+			body, err := json.Marshal(&PostLivecommentRequest{Comment: comment})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, rec := newTestContext(http.MethodPost, "/api/livestream/10/livecomment", bytes.NewReader(body))
+			withLoginSession(c, 2, "viewer")
+			withParams(c, "livestream_id", "10")
+			if got := statusOf(postLivecommentHandler(c), rec); got != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// 登録時に既存のライブコメントにも同じ照合をかける
+func TestModerateDeletesNGWordVariants(t *testing.T) {
+	db := setupTestMySQL(t)
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', ''), (2, 'viewer', '', '', '')",
+		"INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, 0)",
+	)
+	for _, comment := range append(ngWordVariants, "ham") {
+		if _, err := db.Exec("INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (2, 10, ?, 0, 0)", comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/10/moderate", strings.NewReader(`{"ng_word":"Spam"}`))
+	withLoginSession(c, 1, "streamer")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(moderateHandler(c), rec); got != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", got, http.StatusCreated)
+	}
+
+	var remaining []string
+	if err := db.Select(&remaining, "SELECT comment FROM livecomments"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, []string{"ham"}) {
+		t.Errorf("remaining livecomments = %v, want [ham]", remaining)
+	}
+}
+
+func TestDeleteReportedLivecommentKeepsReportsListable(t *testing.T) {
+	db := setupTestMySQL(t)
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', ''), (2, 'viewer', '', '', '')",
+		"INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, 0)",
+		"INSERT INTO livecomments (id, user_id, livestream_id, comment, tip, created_at) VALUES (100, 2, 10, 'spam', 0, 0)",
+		"INSERT INTO livecomment_reports (user_id, livestream_id, livecomment_id, reason, created_at) VALUES (1, 10, 100, 'spam', 0)",
+	)
+
+	c, rec := newTestContext(http.MethodDelete, "/api/livestream/10/livecomment/100", nil)
+	withLoginSession(c, 1, "streamer")
+	withParams(c, "livestream_id", "10", "livecomment_id", "100")
+	if got := statusOf(deleteLivecommentHandler(c), rec); got != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want %d", got, http.StatusNoContent)
+	}
+
+	c, rec = newTestContext(http.MethodGet, "/api/livestream/10/report", nil)
+	withLoginSession(c, 1, "streamer")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(getLivecommentReportsHandler(c), rec); got != http.StatusOK {
+		t.Fatalf("reports status = %d, want %d", got, http.StatusOK)
+	}
+	var reports []LivecommentReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Errorf("reports = %+v, want none", reports)
+	}
+}
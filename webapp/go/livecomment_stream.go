@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultLivecommentBacklog = 50
+	livecommentSubscriberBuf  = 64
+	wsWriteTimeout            = 10 * time.Second
+	wsPongTimeout             = 60 * time.Second
+	wsPingInterval            = wsPongTimeout * 9 / 10
+)
+
+// 配信ごとに、WebSocketで接続しているクライアントへ新着ライブコメントを配る
+type livecommentBroker struct {
+	mtx         sync.Mutex
+	subscribers map[int64]map[chan Livecomment]struct{}
+}
+
+var livecommentHub = &livecommentBroker{
+	subscribers: make(map[int64]map[chan Livecomment]struct{}),
+}
+
+func (b *livecommentBroker) subscribe(livestreamID int64) chan Livecomment {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	ch := make(chan Livecomment, livecommentSubscriberBuf)
+	if b.subscribers[livestreamID] == nil {
+		b.subscribers[livestreamID] = make(map[chan Livecomment]struct{})
+	}
+	b.subscribers[livestreamID][ch] = struct{}{}
+	return ch
+}
+
+func (b *livecommentBroker) unsubscribe(livestreamID int64, ch chan Livecomment) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.subscribers[livestreamID], ch)
+	if len(b.subscribers[livestreamID]) == 0 {
+		delete(b.subscribers, livestreamID)
+	}
+}
+
+// 受信が追いつかないクライアントのために投稿をブロックしないよう、バッファが埋まっていたら捨てる
+func (b *livecommentBroker) publish(livecomment Livecomment) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subscribers[livecomment.Livestream.ID] {
+		select {
+		case ch <- livecomment:
+		default:
+		}
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{}
+
+// ライブコメントのタイムラインをWebSocketで配信する
+// 接続直後に直近のライブコメントを古い順に送り、その後は新着を送る
+// GET /api/livestream/:livestream_id/livecomment/ws
+func livecommentStreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	limit := defaultLivecommentBacklog
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+	}
+
+	// バックログ取得中の投稿を取りこぼさないよう、先に購読しておく
+	ch := livecommentHub.subscribe(livestreamID)
+	defer livecommentHub.unsubscribe(livestreamID, ch)
+
+	backlog, err := getLivecommentBacklog(ctx, livestreamID, limit)
+	if err != nil {
+		return err
+	}
+	var lastID int64
+	if len(backlog) > 0 {
+		lastID = backlog[len(backlog)-1].ID
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// Upgradeがエラーレスポンスを書き込み済み
+		c.Logger().Warnf("failed to upgrade websocket: %v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 書き込みは専用のgoroutineで行う
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+
+		for _, livecomment := range backlog {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(livecomment); err != nil {
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case livecomment := <-ch:
+				if livecomment.ID <= lastID {
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				if err := conn.WriteJSON(livecomment); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// クライアントからのメッセージは読み捨て、切断を検知したら終了する
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	<-done
+	return nil
+}
+
+// 直近limit件のライブコメントを古い順に返す
+func getLivecommentBacklog(ctx context.Context, livestreamID int64, limit int) ([]Livecomment, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel := LivestreamModel{}
+	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	livestreamUser, err := getUserWithCache(ctx, livestreamModel.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user id: %w", err)
+	}
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags id: %w", err)
+	}
+
+	livecommentModels := []LivecommentModel{}
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY id DESC LIMIT ?", livestreamID, limit); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	for i, j := 0, len(livecommentModels)-1; i < j; i, j = i+1, j-1 {
+		livecommentModels[i], livecommentModels[j] = livecommentModels[j], livecommentModels[i]
+	}
+
+	livecomments, err := fillLivecommentsResponse(ctx, tx, livecommentModels, &livestreamModel, tagsId, livestreamUser)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	return livecomments, nil
+}
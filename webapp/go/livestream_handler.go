@@ -3,18 +3,23 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	maxIdempotencyKeyLen   = 255
+	mysqlErrDuplicateEntry = 1062
+)
+
 type ReserveLivestreamRequest struct {
 	Tags         []int64 `json:"tags"`
 	Title        string  `json:"title"`
@@ -25,10 +30,56 @@ type ReserveLivestreamRequest struct {
 	EndAt        int64   `json:"end_at"`
 }
 
+// 2023/11/25 10:00からの１年間が予約期間
+var (
+	reservationTermStartAt = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	reservationTermEndAt   = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
+)
+
+// 予約枠は1時間ごとなので、開始・終了時刻は正時でなければならない
+const reservationSlotSeconds = 60 * 60
+
+func (r *ReserveLivestreamRequest) validate() []FieldError {
+	var errs []FieldError
+	if r.Title == "" {
+		errs = append(errs, FieldError{Field: "title", Message: "must not be empty"})
+	}
+	if r.PlaylistUrl == "" {
+		errs = append(errs, FieldError{Field: "playlist_url", Message: "must not be empty"})
+	}
+	if r.StartAt <= 0 {
+		errs = append(errs, FieldError{Field: "start_at", Message: "must be positive unix seconds"})
+	} else if r.StartAt%reservationSlotSeconds != 0 {
+		errs = append(errs, FieldError{Field: "start_at", Message: "must be on the hour"})
+	} else if r.StartAt >= reservationTermEndAt.Unix() {
+		errs = append(errs, FieldError{Field: "start_at", Message: fmt.Sprintf("must be before %d", reservationTermEndAt.Unix())})
+	}
+	if r.EndAt <= 0 {
+		errs = append(errs, FieldError{Field: "end_at", Message: "must be positive unix seconds"})
+	} else if r.EndAt%reservationSlotSeconds != 0 {
+		errs = append(errs, FieldError{Field: "end_at", Message: "must be on the hour"})
+	} else if r.EndAt <= r.StartAt {
+		errs = append(errs, FieldError{Field: "end_at", Message: "must be after start_at"})
+	} else if r.EndAt <= reservationTermStartAt.Unix() {
+		errs = append(errs, FieldError{Field: "end_at", Message: fmt.Sprintf("must be after %d", reservationTermStartAt.Unix())})
+	}
+	return errs
+}
+
 type LivestreamViewerModel struct {
 	UserID       int64 `db:"user_id" json:"user_id"`
 	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
 	CreatedAt    int64 `db:"created_at" json:"created_at"`
+	UpdatedAt    int64 `db:"updated_at" json:"updated_at"`
+}
+
+// 視聴者はこの間隔でハートビートを送ることを推奨する
+// 直近 2 * viewerHeartbeatInterval 以内にハートビートのあった視聴者を「現在の視聴者」として数える
+const viewerHeartbeatInterval = 30 * time.Second
+
+// 現在の視聴者とみなす最後のハートビート時刻の下限
+func liveViewerThreshold() int64 {
+	return time.Now().Add(-2 * viewerHeartbeatInterval).Unix()
 }
 
 type LivestreamModel struct {
@@ -55,6 +106,10 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	// 人気度の目安として、統計APIと同じ集計値を返す
+	TotalReactions int64 `json:"total_reactions"`
+	TotalTips      int64 `json:"total_tips"`
+	MaxTip         int64 `json:"max_tip"`
 }
 
 type LivestreamTagModel struct {
@@ -70,23 +125,34 @@ type ReservationSlotModel struct {
 	EndAt   int64 `db:"end_at" json:"end_at"`
 }
 
+type ReservationSlotRange struct {
+	StartAt int64 `db:"start_at" json:"start_at"`
+	EndAt   int64 `db:"end_at" json:"end_at"`
+}
+
 func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *ReserveLivestreamRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
+	if fieldErrors := req.validate(); len(fieldErrors) > 0 {
+		return newValidationError("invalid reservation request", fieldErrors)
+	}
+
+	idempotencyKey := c.Request().Header.Get(idempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLen {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLen))
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -95,33 +161,49 @@ func reserveLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	// 同じIdempotency-Keyで予約済みなら、予約枠を消費せずに前回の結果を返す
+	if idempotencyKey != "" {
+		expiredAt := time.Now().Add(-idempotencyKeyTTL).Unix()
+		if _, err := tx.ExecContext(ctx, "DELETE FROM reservation_idempotency_keys WHERE user_id = ? AND idempotency_key = ? AND created_at <= ?", userID, idempotencyKey, expiredAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete expired idempotency key: "+err.Error())
+		}
+
+		var reservedLivestreamID int64
+		err := tx.GetContext(ctx, &reservedLivestreamID, "SELECT livestream_id FROM reservation_idempotency_keys WHERE user_id = ? AND idempotency_key = ?", userID, idempotencyKey)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get idempotency key: "+err.Error())
+		}
+		if err == nil {
+			return replayReservation(c, tx, userID, reservedLivestreamID)
+		}
 	}
 
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+	// NOTE: 対象の予約枠すべてを残数が1以上の場合のみ条件付きUPDATEで減らし、
+	//       更新できた行数が対象の枠数に満たなければロールバックしてoverbookingを防ぐ
+	var slotCount int64
+	if err := tx.GetContext(ctx, &slotCount, "SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	rs, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ? AND slot > 0", req.StartAt, req.EndAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	reserved, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if reserved != slotCount {
+		// 減らした枠を元に戻してから、埋まっている枠を調べて返す
+		if err := tx.Rollback(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to rollback: "+err.Error())
 		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+		unavailableSlots := []ReservationSlotRange{}
+		if err := dbConn.SelectContext(ctx, &unavailableSlots, "SELECT start_at, end_at FROM reservation_slots WHERE start_at >= ? AND end_at <= ? AND slot < 1 ORDER BY start_at", req.StartAt, req.EndAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 		}
+		return newSlotUnavailableError(fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", reservationTermStartAt.Unix(), reservationTermEndAt.Unix(), req.StartAt, req.EndAt), unavailableSlots)
 	}
 
 	var (
@@ -136,11 +218,7 @@ func reserveLivestreamHandler(c echo.Context) error {
 		}
 	)
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
-	}
-
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	rs, err = tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
@@ -173,10 +251,52 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
+	if idempotencyKey != "" {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO reservation_idempotency_keys (user_id, idempotency_key, livestream_id, created_at) VALUES (?, ?, ?, ?)", userID, idempotencyKey, livestreamID, time.Now().Unix()); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+				// 同じキーの予約が並行して処理された
+				return echo.NewHTTPError(http.StatusConflict, "reservation with the same idempotency key is in progress")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert idempotency key: "+err.Error())
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	invalidateLivestreamTags(livestreamID)
 
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/livestream/%d", livestreamID))
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// Idempotency-Keyで予約済みのライブ配信を返す
+func replayReservation(c echo.Context, tx *sqlx.Tx, userID int64, livestreamID int64) error {
+	ctx := c.Request().Context()
+
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reserved livestream: "+err.Error())
+	}
+	tagIDs, err := getLivestreamTagIDs(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	user, err := getUserWithCache(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	livestream, err := fillLivestreamResponse(ctx, &livestreamModel, user, tagIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/livestream/%d", livestreamID))
 	return c.JSON(http.StatusCreated, livestream)
 }
 
@@ -190,6 +310,21 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 配信者による絞り込み
+	var ownerCond string
+	var ownerParams []interface{}
+	if owner := c.QueryParam("owner"); owner != "" {
+		ownerModel, err := getUserByName(ctx, owner)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given owner username")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get owner: "+err.Error())
+		}
+		ownerCond = " WHERE livestreams.user_id = ?"
+		ownerParams = append(ownerParams, ownerModel.ID)
+	}
+
 	var livestreamModels []*LivestreamModel
 	if c.QueryParam("tag") != "" {
 		// タグによる取得
@@ -198,7 +333,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 		}
 
-		query, params, err := sqlx.In("SELECT livestreams.`id`, livestreams.`user_id`, livestreams.`title`, livestreams.`description`, livestreams.`playlist_url`, livestreams.`thumbnail_url`, livestreams.`start_at`, livestreams.`end_at` FROM livestreams JOIN livestream_tags ON livestream_tags.tag_id IN (?) AND livestream_tags.livestream_id = livestreams.id ORDER BY livestreams.id DESC", tagIDList)
+		query, params, err := sqlx.In("SELECT livestreams.`id`, livestreams.`user_id`, livestreams.`title`, livestreams.`description`, livestreams.`playlist_url`, livestreams.`thumbnail_url`, livestreams.`start_at`, livestreams.`end_at`, livestreams.`reactions`, livestreams.`tips`, livestreams.`max_tip` FROM livestreams JOIN livestream_tags ON livestream_tags.tag_id IN (?) AND livestream_tags.livestream_id = livestreams.id"+ownerCond+" ORDER BY livestreams.id DESC", append([]interface{}{tagIDList}, ownerParams...)...)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
 		}
@@ -206,8 +341,8 @@ func searchLivestreamsHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
 		}
 	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
+		// タグの検索条件なし
+		query := "SELECT * FROM livestreams" + ownerCond + " ORDER BY id DESC"
 		if c.QueryParam("limit") != "" {
 			limit, err := strconv.Atoi(c.QueryParam("limit"))
 			if err != nil {
@@ -216,29 +351,21 @@ func searchLivestreamsHandler(c echo.Context) error {
 			query += fmt.Sprintf(" LIMIT %d", limit)
 		}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
+		if err := tx.SelectContext(ctx, &livestreamModels, query, ownerParams...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
 	}
 
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, model := range livestreamModels {
+		livestreamIDs[i] = model.ID
+	}
+	tags, err := loadTagsForLivestreams(ctx, tx, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
 	users := make(map[int64]*UserModel)
-	tags := make(map[int64][]int64)
 	if len(livestreamModels) > 0 {
-		livestreamIds := make([]int64, len(livestreamModels))
-		for i, model := range livestreamModels {
-			livestreamIds[i] = model.ID
-		}
-		query, params, err := sqlx.In("SELECT livestream_id, tag_id FROM livestream_tags WHERE livestream_id IN (?)", livestreamIds)
-		if err != nil {
-			return fmt.Errorf("invalid query: %x", err)
-		}
-		var tagModels []LivestreamTagModel
-		if err := tx.SelectContext(ctx, &tagModels, query, params...); err != nil {
-			return fmt.Errorf("failed to get tags id")
-		}
-		for _, tagModel := range tagModels {
-			tags[tagModel.LivestreamID] = append(tags[tagModel.LivestreamID], tagModel.TagID)
-		}
 		userIds := make([]int64, 0)
 		for _, model := range livestreamModels {
 			userModel := getUserOnlyCache(model.UserID)
@@ -249,7 +376,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 			}
 		}
 		if len(userIds) > 0 {
-			query, params, err = sqlx.In("SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users WHERE id IN (?)", userIds)
+			query, params, err := sqlx.In("SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users WHERE id IN (?)", userIds)
 			if err != nil {
 				return fmt.Errorf("invalid query: %x", err)
 			}
@@ -275,12 +402,19 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if wantsEmbeddedIcon(c) {
+		if err := embedOwnerIcons(livestreams); err != nil {
+			return err
+		}
+	}
+
 	return c.JSON(http.StatusOK, livestreams)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
@@ -290,10 +424,6 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
 	user, err := getUserWithCache(ctx, userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -306,23 +436,13 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	tags := make(map[int64][]int64)
-	if len(livestreamModels) > 0 {
-		livestreamIds := make([]int64, len(livestreamModels))
-		for i, model := range livestreamModels {
-			livestreamIds[i] = model.ID
-		}
-		query, params, err := sqlx.In("SELECT livestream_id, tag_id FROM livestream_tags WHERE livestream_id IN (?)", livestreamIds)
-		if err != nil {
-			return fmt.Errorf("invalid query: %x", err)
-		}
-		var tagModels []LivestreamTagModel
-		if err := tx.SelectContext(ctx, &tagModels, query, params...); err != nil {
-			return fmt.Errorf("failed to get tags id")
-		}
-		for _, tagModel := range tagModels {
-			tags[tagModel.LivestreamID] = append(tags[tagModel.LivestreamID], tagModel.TagID)
-		}
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, model := range livestreamModels {
+		livestreamIDs[i] = model.ID
+	}
+	tags, err := loadTagsForLivestreams(ctx, tx, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
@@ -337,10 +457,33 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if wantsEmbeddedIcon(c) {
+		if err := embedOwnerIcons(livestreams); err != nil {
+			return err
+		}
+	}
+
 	return c.JSON(http.StatusOK, livestreams)
 }
 
 func getUserLivestreamsHandler(c echo.Context) error {
+	return respondUserLivestreams(c, "", "")
+}
+
+// ユーザの開始前のライブ配信を開始が近い順に取得
+// GET /api/user/:username/livestreams/upcoming
+func getUserUpcomingLivestreamsHandler(c echo.Context) error {
+	return respondUserLivestreams(c, "start_at > ?", "start_at ASC", time.Now().Unix())
+}
+
+// ユーザの終了したライブ配信を終了が新しい順に取得
+// GET /api/user/:username/livestreams/past
+func getUserPastLivestreamsHandler(c echo.Context) error {
+	return respondUserLivestreams(c, "end_at <= ?", "end_at DESC", time.Now().Unix())
+}
+
+// cond, orderが空の場合はユーザのライブ配信をすべて取得する
+func respondUserLivestreams(c echo.Context, cond string, order string, args ...interface{}) error {
 	ctx := c.Request().Context()
 	if err := verifyUserSession(c); err != nil {
 		return err
@@ -362,27 +505,24 @@ func getUserLivestreamsHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 		}
 	}
+	query := "SELECT * FROM livestreams WHERE user_id = ?"
+	if cond != "" {
+		query += " AND " + cond
+	}
+	if order != "" {
+		query += " ORDER BY " + order
+	}
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	if err := tx.SelectContext(ctx, &livestreamModels, query, append([]interface{}{user.ID}, args...)...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	tags := make(map[int64][]int64)
-	if len(livestreamModels) > 0 {
-		livestreamIds := make([]int64, len(livestreamModels))
-		for i, model := range livestreamModels {
-			livestreamIds[i] = model.ID
-		}
-		query, params, err := sqlx.In("SELECT livestream_id, tag_id FROM livestream_tags WHERE livestream_id IN (?)", livestreamIds)
-		if err != nil {
-			return fmt.Errorf("invalid query: %x", err)
-		}
-		var tagModels []LivestreamTagModel
-		if err := tx.SelectContext(ctx, &tagModels, query, params...); err != nil {
-			return fmt.Errorf("failed to get tags id")
-		}
-		for _, tagModel := range tagModels {
-			tags[tagModel.LivestreamID] = append(tags[tagModel.LivestreamID], tagModel.TagID)
-		}
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i, model := range livestreamModels {
+		livestreamIDs[i] = model.ID
+	}
+	tags, err := loadTagsForLivestreams(ctx, tx, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
 	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
@@ -397,22 +537,23 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if wantsEmbeddedIcon(c) {
+		if err := embedOwnerIcons(livestreams); err != nil {
+			return err
+		}
+	}
+
 	return c.JSON(http.StatusOK, livestreams)
 }
 
 // viewerテーブルの廃止
 func enterLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
@@ -424,13 +565,35 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
-	}
-
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if enforceEnterWindow && (viewer.CreatedAt < livestreamModel.StartAt || viewer.CreatedAt > livestreamModel.EndAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't enter a livestream that is not live")
+	}
+
+	// 同じユーザが再入室した場合は入室時刻だけ更新し、視聴者数を重複して数えない
+	// 退室せずに再入室した場合は、それまでの視聴時間を累計に加えてから入室し直したものとして扱う
+	// 視聴時間は統計と同じく配信終了時刻までで打ち切る
+	// (ON DUPLICATE KEY UPDATEは左から順に評価されるので、watch_secondsは更新前の値で計算される)
+	if _, err := tx.ExecContext(ctx, `INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at, updated_at) VALUES(?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			watch_seconds = watch_seconds + IF(ended_at IS NULL, GREATEST(LEAST(VALUES(created_at), ?) - created_at, 0), 0),
+			created_at = VALUES(created_at),
+			updated_at = VALUES(updated_at),
+			ended_at = NULL`, viewer.UserID, viewer.LivestreamID, viewer.CreatedAt, viewer.UpdatedAt, livestreamModel.EndAt); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
 
@@ -443,16 +606,11 @@ func enterLivestreamHandler(c echo.Context) error {
 
 func exitLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -464,8 +622,11 @@ func exitLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	// 視聴時間を集計できるよう、削除せずに退室時刻を記録する
+	// 視聴時間は統計と同じく配信終了時刻までで打ち切る
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_viewers_history h INNER JOIN livestreams l ON l.id = h.livestream_id SET h.watch_seconds = h.watch_seconds + GREATEST(LEAST(?, l.end_at) - h.created_at, 0), h.ended_at = ? WHERE h.user_id = ? AND h.livestream_id = ? AND h.ended_at IS NULL", now, now, userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream_view_history: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -475,6 +636,42 @@ func exitLivestreamHandler(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
+// 視聴中であることを通知する (viewerHeartbeatInterval ごとに呼ぶ)
+// POST /api/livestream/:livestream_id/heartbeat
+func postViewerHeartbeatHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE livestream_viewers_history SET updated_at = ? WHERE user_id = ? AND livestream_id = ? AND ended_at IS NULL", time.Now().Unix(), userID, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream_view_history: "+err.Error())
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if affected == 0 {
+		// 同じ秒に更新済みの場合も0件になるので、視聴中かどうかを確認し直す
+		var watching bool
+		if err := dbConn.GetContext(ctx, &watching, "SELECT EXISTS(SELECT 1 FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ? AND ended_at IS NULL)", userID, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+		}
+		if !watching {
+			return echo.NewHTTPError(http.StatusNotFound, "not entered the livestream")
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 func getLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -505,8 +702,8 @@ func getLivestreamHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to get user id: %w", err)
 	}
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
 	livestream, err := fillLivestreamResponse(ctx, &livestreamModel, user, tagsId)
@@ -521,10 +718,14 @@ func getLivestreamHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livestream)
 }
 
+// 通報一覧の1ページあたりの最大件数
+const maxLivecommentReportsLimit = 100
+
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
@@ -541,20 +742,47 @@ func getLivecommentReportsHandler(c echo.Context) error {
 
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	if livestreamModel.UserID != userID {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
+	// 新しい順に返す
+	//   reason: 指定された通報理由のみに絞り込む
+	//   before_id: それより古い通報を limit 件 (過去に遡るページング)
+	query := "SELECT * FROM livecomment_reports WHERE livestream_id = ?"
+	params := []interface{}{livestreamID}
+	if reason := c.QueryParam("reason"); reason != "" {
+		if !isValidReportReason(reason) {
+			return echo.NewHTTPError(http.StatusBadRequest, "reason query parameter must be one of spam, harassment, other")
+		}
+		query += " AND reason = ?"
+		params = append(params, reason)
+	}
+	if c.QueryParam("before_id") != "" {
+		beforeID, err := strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+		query += " AND id < ?"
+		params = append(params, beforeID)
+	}
+	query += " ORDER BY id DESC"
+	if c.QueryParam("limit") != "" {
+		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxLivecommentReportsLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxLivecommentReportsLimit))
+		}
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
 	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reportModels, query, params...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
@@ -590,25 +818,26 @@ func getLivecommentReportsHandler(c echo.Context) error {
 			return fmt.Errorf("failed to get livecomment users: %w", err)
 		}
 	}
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
 	liveOwner, err := getUserWithCache(ctx, livestreamModel.UserID)
 	if err != nil {
 		return fmt.Errorf("failed to get user id: %w", err)
 	}
-	reports := make([]LivecommentReport, len(reportModels))
+	reports := make([]LivecommentReport, 0, len(reportModels))
 	for i := range reportModels {
+		// 対象のコメントが既に削除されている通報は返さない
 		comment := livecommentModels[reportModels[i].LivecommentID]
 		if comment == nil {
-			return fmt.Errorf("comment not found")
+			continue
 		}
 		report, err := fillLivecommentReportResponse(ctx, reportModels[i], comment, &livestreamModel, tagsId, liveOwner, livecommentUsers[comment.UserID], reportUsers[reportModels[i].UserID])
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 		}
-		reports[i] = report
+		reports = append(reports, report)
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -618,6 +847,72 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, reports)
 }
 
+// ライブ配信ごとのタグIDをまとめて取得する
+// キャッシュにないものだけをDBから読み込む
+func loadTagsForLivestreams(ctx context.Context, tx *sqlx.Tx, ids []int64) (map[int64][]int64, error) {
+	tags := make(map[int64][]int64, len(ids))
+	missingIDs := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if tagIDs, found := livestreamTagsCache.Get(livestreamTagsCacheKey(id)); found {
+			tags[id] = tagIDs.([]int64)
+		} else {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+	if len(missingIDs) == 0 {
+		return tags, nil
+	}
+	query, params, err := sqlx.In("SELECT livestream_id, tag_id FROM livestream_tags WHERE livestream_id IN (?)", missingIDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	var tagModels []LivestreamTagModel
+	if err := tx.SelectContext(ctx, &tagModels, query, params...); err != nil {
+		return nil, fmt.Errorf("failed to get tags id: %w", err)
+	}
+	for _, tagModel := range tagModels {
+		tags[tagModel.LivestreamID] = append(tags[tagModel.LivestreamID], tagModel.TagID)
+	}
+	for _, id := range missingIDs {
+		// タグのないライブ配信も空のスライスとしてキャッシュする
+		if tags[id] == nil {
+			tags[id] = []int64{}
+		}
+		livestreamTagsCache.Set(livestreamTagsCacheKey(id), tags[id])
+	}
+	return tags, nil
+}
+
+func getLivestreamTagIDs(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]int64, error) {
+	tags, err := loadTagsForLivestreams(ctx, tx, []int64{livestreamID})
+	if err != nil {
+		return nil, err
+	}
+	return tags[livestreamID], nil
+}
+
+// 複数のライブ配信をまとめて取得する
+// reactions, tipsなどの集計カラムが頻繁に更新されるため、ユーザと違いキャッシュはしない
+func getLivestreamsByIDs(ctx context.Context, tx *sqlx.Tx, ids []int64) (map[int64]*LivestreamModel, error) {
+	ret := make(map[int64]*LivestreamModel, len(ids))
+	if len(ids) == 0 {
+		return ret, nil
+	}
+
+	query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct IN query: %w", err)
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return nil, fmt.Errorf("failed to get livestreams: %w", err)
+	}
+	for _, livestreamModel := range livestreamModels {
+		ret[livestreamModel.ID] = livestreamModel
+	}
+	return ret, nil
+}
+
 func fillLivestreamResponse(ctx context.Context, livestreamModel *LivestreamModel, userModel *UserModel, tagIds []int64) (Livestream, error) {
 	owner, err := fillUserResponse(ctx, userModel)
 	if err != nil {
@@ -628,7 +923,7 @@ func fillLivestreamResponse(ctx context.Context, livestreamModel *LivestreamMode
 	for _, tagId := range tagIds {
 		tags = append(tags, Tag{
 			ID:   tagId,
-			Name: TAGS[tagId],
+			Name: getTagName(tagId),
 		})
 	}
 
@@ -642,6 +937,10 @@ func fillLivestreamResponse(ctx context.Context, livestreamModel *LivestreamMode
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+
+		TotalReactions: livestreamModel.Reactions,
+		TotalTips:      livestreamModel.Tips,
+		MaxTip:         livestreamModel.MaxTip,
 	}
 	return livestream, nil
 }
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+)
+
+var livestreamColumns = []string{"id", "user_id", "title", "description", "playlist_url", "thumbnail_url", "start_at", "end_at", "reactions", "tips", "max_tip"}
+
+func livestreamRows(ls ...LivestreamModel) *sqlmock.Rows {
+	rows := sqlmock.NewRows(livestreamColumns)
+	for _, l := range ls {
+		rows.AddRow(l.ID, l.UserID, l.Title, l.Description, l.PlaylistUrl, l.ThumbnailUrl, l.StartAt, l.EndAt, l.Reactions, l.Tips, l.MaxTip)
+	}
+	return rows
+}
+
+func setEnforceEnterWindow(t *testing.T, v bool) {
+	prev := enforceEnterWindow
+	enforceEnterWindow = v
+	t.Cleanup(func() { enforceEnterWindow = prev })
+}
+
+func TestEnterLivestreamWindow(t *testing.T) {
+	now := time.Now()
+	hour := int64(time.Hour / time.Second)
+	cases := []struct {
+		name    string
+		enforce bool
+		startAt int64
+		endAt   int64
+		want    int
+	}{
+		{"inside window", true, now.Unix() - hour, now.Unix() + hour, http.StatusOK},
+		{"before start", true, now.Unix() + hour, now.Unix() + 2*hour, http.StatusBadRequest},
+		{"after end", true, now.Unix() - 2*hour, now.Unix() - hour, http.StatusBadRequest},
+		{"outside window but disabled", false, now.Unix() - 2*hour, now.Unix() - hour, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			setEnforceEnterWindow(t, tc.enforce)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+				WithArgs(1).
+				WillReturnRows(livestreamRows(LivestreamModel{ID: 1, UserID: 2, StartAt: tc.startAt, EndAt: tc.endAt}))
+			if tc.want == http.StatusOK {
+				mock.ExpectExec("INSERT INTO livestream_viewers_history").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			c, rec := newTestContext(http.MethodPost, "/api/livestream/1/enter", nil)
+			withLoginSession(c, 10, "viewer")
+			withParams(c, "livestream_id", "1")
+			if got := statusOf(enterLivestreamHandler(c), rec); got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEnterLivestreamNotFound(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(404).
+		WillReturnRows(livestreamRows())
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/404/enter", nil)
+	withLoginSession(c, 10, "viewer")
+	withParams(c, "livestream_id", strconv.Itoa(404))
+	if got := statusOf(enterLivestreamHandler(c), rec); got != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestGetLivecommentReportsLimit(t *testing.T) {
+	for _, limit := range []string{"-1", "0", "101", "abc"} {
+		t.Run(limit, func(t *testing.T) {
+			mock := setupMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+				WithArgs(1).
+				WillReturnRows(livestreamRows(LivestreamModel{ID: 1, UserID: 10}))
+			mock.ExpectRollback()
+
+			c, rec := newTestContext(http.MethodGet, "/api/livestream/1/report?limit="+limit, nil)
+			withLoginSession(c, 10, "streamer")
+			withParams(c, "livestream_id", "1")
+			if got := statusOf(getLivecommentReportsHandler(c), rec); got != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestGetLivecommentReportsLivestreamNotFound(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(999).
+		WillReturnRows(livestreamRows())
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/999/report", nil)
+	withLoginSession(c, 10, "streamer")
+	withParams(c, "livestream_id", "999")
+	if got := statusOf(getLivecommentReportsHandler(c), rec); got != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestReserveLivestreamRequestValidate(t *testing.T) {
+	// 2024/01/01 00:00 UTC
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	hour := int64(reservationSlotSeconds)
+	valid := ReserveLivestreamRequest{Title: "title", PlaylistUrl: "https://example.com/playlist.m3u8", StartAt: base, EndAt: base + hour}
+
+	cases := []struct {
+		name   string
+		modify func(r *ReserveLivestreamRequest)
+		fields []string
+	}{
+		{"valid", func(r *ReserveLivestreamRequest) {}, nil},
+		{"empty title", func(r *ReserveLivestreamRequest) { r.Title = "" }, []string{"title"}},
+		{"empty playlist_url", func(r *ReserveLivestreamRequest) { r.PlaylistUrl = "" }, []string{"playlist_url"}},
+		{"zero start_at", func(r *ReserveLivestreamRequest) { r.StartAt = 0 }, []string{"start_at"}},
+		{"negative end_at", func(r *ReserveLivestreamRequest) { r.EndAt = -1 }, []string{"end_at"}},
+		{"start_at not on the hour", func(r *ReserveLivestreamRequest) { r.StartAt = base + 1 }, []string{"start_at"}},
+		{"end_at not on the hour", func(r *ReserveLivestreamRequest) { r.EndAt = base + hour + 1 }, []string{"end_at"}},
+		{"end_at before start_at", func(r *ReserveLivestreamRequest) { r.EndAt = base - hour }, []string{"end_at"}},
+		{"end_at equals start_at", func(r *ReserveLivestreamRequest) { r.EndAt = base }, []string{"end_at"}},
+		{"before term", func(r *ReserveLivestreamRequest) {
+			r.StartAt = reservationTermStartAt.Unix() - hour
+			r.EndAt = reservationTermStartAt.Unix()
+		}, []string{"end_at"}},
+		{"after term", func(r *ReserveLivestreamRequest) {
+			r.StartAt = reservationTermEndAt.Unix()
+			r.EndAt = reservationTermEndAt.Unix() + hour
+		}, []string{"start_at"}},
+		{"multiple fields", func(r *ReserveLivestreamRequest) {
+			r.Title = ""
+			r.StartAt = 0
+		}, []string{"title", "start_at"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := valid
+			tc.modify(&req)
+			var fields []string
+			for _, fe := range req.validate() {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Errorf("invalid fields = %v, want %v", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestReserveLivestreamInvalidRequest(t *testing.T) {
+	setupMockDB(t)
+	body := `{"title":"","playlist_url":"https://example.com/playlist.m3u8","start_at":1,"end_at":0}`
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/reservation", strings.NewReader(body))
+	withLoginSession(c, 1, "streamer")
+	errorResponseHandler(reserveLivestreamHandler(c), c)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != errCodeValidationFailed {
+		t.Errorf("code = %s, want %s", res.Code, errCodeValidationFailed)
+	}
+	var fields []string
+	for _, fe := range res.Fields {
+		fields = append(fields, fe.Field)
+	}
+	if want := []string{"title", "start_at", "end_at"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("invalid fields = %v, want %v", fields, want)
+	}
+}
+
+func TestReserveLivestreamLocation(t *testing.T) {
+	mock := setupMockDB(t)
+	cacheUserForTest(&UserModel{ID: 1, Name: "streamer"})
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + reservationSlotSeconds
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ?")).
+		WithArgs(startAt, endAt).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE reservation_slots SET slot = slot - 1")).
+		WithArgs(startAt, endAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO livestreams")).
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectCommit()
+
+	body := fmt.Sprintf(`{"tags":[],"title":"title","description":"","playlist_url":"https://example.com/playlist.m3u8","thumbnail_url":"","start_at":%d,"end_at":%d}`, startAt, endAt)
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/reservation", strings.NewReader(body))
+	withLoginSession(c, 1, "streamer")
+	if got := statusOf(reserveLivestreamHandler(c), rec); got != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", got, http.StatusCreated, rec.Body.String())
+	}
+	if got, want := rec.Header().Get(echo.HeaderLocation), "/api/livestream/42"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	var livestream Livestream
+	if err := json.Unmarshal(rec.Body.Bytes(), &livestream); err != nil {
+		t.Fatal(err)
+	}
+	if livestream.ID != 42 {
+		t.Errorf("id = %d, want 42", livestream.ID)
+	}
+}
+
+// 同じ枠への予約が集中しても、枠の数を超えて予約できない
+// 条件付きUPDATEの行ロックに頼っているので、InnoDBのMySQLで実行する
+func TestReserveLivestreamConcurrentNoOverbooking(t *testing.T) {
+	db := setupTestMySQL(t)
+	const (
+		slots       = 3
+		concurrency = 20
+	)
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + 2*reservationSlotSeconds
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', '')",
+		fmt.Sprintf("INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (%d, %d, %d), (%d, %d, %d)",
+			slots, startAt, startAt+reservationSlotSeconds, slots, startAt+reservationSlotSeconds, endAt),
+	)
+
+	body := fmt.Sprintf(`{"tags":[],"title":"title","description":"","playlist_url":"https://example.com/playlist.m3u8","thumbnail_url":"","start_at":%d,"end_at":%d}`, startAt, endAt)
+	statuses := make(chan int, concurrency)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, rec := newTestContext(http.MethodPost, "/api/livestream/reservation", strings.NewReader(body))
+			withLoginSession(c, 1, "streamer")
+			<-start
+			statuses <- statusOf(reserveLivestreamHandler(c), rec)
+		}()
+	}
+	began := time.Now()
+	close(start)
+	wg.Wait()
+	elapsed := time.Since(began)
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	t.Logf("%d reservations in %s (%.0f req/s)", concurrency, elapsed, float64(concurrency)/elapsed.Seconds())
+
+	if created != slots {
+		t.Errorf("created = %d, want %d", created, slots)
+	}
+	var livestreams int
+	if err := db.Get(&livestreams, "SELECT COUNT(*) FROM livestreams"); err != nil {
+		t.Fatal(err)
+	}
+	if livestreams != slots {
+		t.Errorf("livestreams = %d, want %d", livestreams, slots)
+	}
+	var remaining []int64
+	if err := db.Select(&remaining, "SELECT slot FROM reservation_slots ORDER BY start_at"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, []int64{0, 0}) {
+		t.Errorf("remaining slots = %v, want [0 0]", remaining)
+	}
+}
+
+func TestReserveLivestreamIdempotencyKey(t *testing.T) {
+	db := setupTestMySQL(t)
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + reservationSlotSeconds
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', '')",
+		fmt.Sprintf("INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (5, %d, %d)", startAt, endAt),
+	)
+
+	body := fmt.Sprintf(`{"tags":[],"title":"title","description":"","playlist_url":"https://example.com/playlist.m3u8","thumbnail_url":"","start_at":%d,"end_at":%d}`, startAt, endAt)
+	var ids []int64
+	// タイムアウトしたクライアントが同じキーで再送した
+	for i := 0; i < 2; i++ {
+		c, rec := newTestContext(http.MethodPost, "/api/livestream/reservation", strings.NewReader(body))
+		c.Request().Header.Set(idempotencyKeyHeader, "retry-key")
+		withLoginSession(c, 1, "streamer")
+		if got := statusOf(reserveLivestreamHandler(c), rec); got != http.StatusCreated {
+			t.Fatalf("request %d: status = %d, want %d: %s", i, got, http.StatusCreated, rec.Body.String())
+		}
+		var livestream Livestream
+		if err := json.Unmarshal(rec.Body.Bytes(), &livestream); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, livestream.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("livestream ids = %v, want the same id", ids)
+	}
+
+	var slot int64
+	if err := db.Get(&slot, "SELECT slot FROM reservation_slots"); err != nil {
+		t.Fatal(err)
+	}
+	if slot != 4 {
+		t.Errorf("slot = %d, want 4 (decremented once)", slot)
+	}
+	var livestreams int
+	if err := db.Get(&livestreams, "SELECT COUNT(*) FROM livestreams"); err != nil {
+		t.Fatal(err)
+	}
+	if livestreams != 1 {
+		t.Errorf("livestreams = %d, want 1", livestreams)
+	}
+}
+
+func TestGetLivestreamsByIDs(t *testing.T) {
+	mock := setupMockDB(t)
+	ctx := context.Background()
+
+	// 存在しないIDはマップに含めず、1回のINクエリでまとめて引く
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id IN (?, ?, ?)")).
+		WithArgs(10, 11, 999).
+		WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}, LivestreamModel{ID: 11, UserID: 2}))
+	mock.ExpectCommit()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// 空なら問い合わせない
+	empty, err := getLivestreamsByIDs(ctx, tx, nil)
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("getLivestreamsByIDs(nil) = %v, %v", empty, err)
+	}
+
+	got, err := getLivestreamsByIDs(ctx, tx, []int64{10, 11, 999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[10].UserID != 1 || got[11].UserID != 2 {
+		t.Errorf("livestreams = %+v, want 10 and 11", got)
+	}
+	if _, ok := got[999]; ok {
+		t.Error("missing livestream 999 is in the result")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 3時間の予約のうち真ん中の枠だけ埋まっている
+func TestReserveLivestreamReportsUnavailableSlots(t *testing.T) {
+	mock := setupMockDB(t)
+	hour := int64(reservationSlotSeconds)
+	startAt := reservationTermStartAt.Unix()
+	endAt := startAt + 3*hour
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ?")).
+		WithArgs(startAt, endAt).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(3))
+	// 空いている前後の枠だけ減らせた
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ? AND slot > 0")).
+		WithArgs(startAt, endAt).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	// 減らした枠は戻し、ライブ配信は作らない
+	mock.ExpectRollback()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT start_at, end_at FROM reservation_slots WHERE start_at >= ? AND end_at <= ? AND slot < 1 ORDER BY start_at")).
+		WithArgs(startAt, endAt).
+		WillReturnRows(sqlmock.NewRows([]string{"start_at", "end_at"}).AddRow(startAt+hour, startAt+2*hour))
+
+	body := fmt.Sprintf(`{"tags":[],"title":"title","description":"","playlist_url":"https://example.com/playlist.m3u8","thumbnail_url":"","start_at":%d,"end_at":%d}`, startAt, endAt)
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/reservation", strings.NewReader(body))
+	withLoginSession(c, 1, "streamer")
+	errorResponseHandler(reserveLivestreamHandler(c), c)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != errCodeSlotUnavailable {
+		t.Errorf("code = %s, want %s", res.Code, errCodeSlotUnavailable)
+	}
+	if want := []ReservationSlotRange{{StartAt: startAt + hour, EndAt: startAt + 2*hour}}; !reflect.DeepEqual(res.UnavailableSlots, want) {
+		t.Errorf("unavailable_slots = %+v, want %+v", res.UnavailableSlots, want)
+	}
+}
+
+// 再入室しても視聴者数は1人のまま
+func TestEnterLivestreamTwiceCountsOneViewer(t *testing.T) {
+	db := setupTestMySQL(t)
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', ''), (2, 'viewer', '', '', '')",
+		"INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, 0)",
+	)
+
+	for i := 0; i < 2; i++ {
+		c, rec := newTestContext(http.MethodPost, "/api/livestream/10/enter", nil)
+		withLoginSession(c, 2, "viewer")
+		withParams(c, "livestream_id", "10")
+		if got := statusOf(enterLivestreamHandler(c), rec); got != http.StatusOK {
+			t.Fatalf("enter %d: status = %d, want %d", i, got, http.StatusOK)
+		}
+	}
+
+	var rows int
+	if err := db.Get(&rows, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = 10"); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("livestream_viewers_history rows = %d, want 1", rows)
+	}
+
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/10/statistics", nil)
+	withLoginSession(c, 1, "streamer")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(getLivestreamStatisticsHandler(c), rec); got != http.StatusOK {
+		t.Fatalf("statistics: status = %d, want %d: %s", got, http.StatusOK, rec.Body.String())
+	}
+	var stats LivestreamStatistics
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.ViewersCount != 1 {
+		t.Errorf("viewers_count = %d, want 1", stats.ViewersCount)
+	}
+}
+
+// 配信終了後に退室・再入室しても、視聴時間は配信終了時刻までしか数えない
+func TestWatchSecondsClampedToLivestreamEnd(t *testing.T) {
+	db := setupTestMySQL(t)
+	setEnforceEnterWindow(t, false)
+	endAt := time.Now().Add(-24 * time.Hour).Unix()
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', ''), (2, 'exit', '', '', ''), (3, 'reenter', '', '', ''), (4, 'stay', '', '', '')",
+		fmt.Sprintf("INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, %d)", endAt),
+		fmt.Sprintf("INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at, updated_at) VALUES (2, 10, %d, %d), (3, 10, %d, %d), (4, 10, %d, %d)", endAt-100, endAt-100, endAt-100, endAt-100, endAt-100, endAt-100),
+	)
+
+	c, rec := newTestContext(http.MethodDelete, "/api/livestream/10/exit", nil)
+	withLoginSession(c, 2, "exit")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(exitLivestreamHandler(c), rec); got != http.StatusOK {
+		t.Fatalf("exit: status = %d, want %d", got, http.StatusOK)
+	}
+	c, rec = newTestContext(http.MethodPost, "/api/livestream/10/enter", nil)
+	withLoginSession(c, 3, "reenter")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(enterLivestreamHandler(c), rec); got != http.StatusOK {
+		t.Fatalf("enter: status = %d, want %d", got, http.StatusOK)
+	}
+
+	var stored []int64
+	if err := db.Select(&stored, "SELECT watch_seconds FROM livestream_viewers_history WHERE user_id IN (2, 3) ORDER BY user_id"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{100, 100}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored watch_seconds = %v, want %v", stored, want)
+	}
+	// 退室しなかった視聴者とも同じ値になる
+	totals, err := getTotalWatchSeconds(context.Background(), db, []int64{2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int64]int64{2: 100, 4: 100}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("total watch seconds = %v, want %v", totals, want)
+	}
+}
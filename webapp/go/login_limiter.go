@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ログイン失敗回数の制限
+// window内にmaxFailures回失敗したキー(ユーザ名・IP)はwindowが明けるまでログインできない
+type loginFailureLimiter struct {
+	mtx         sync.Mutex
+	maxFailures int
+	window      time.Duration
+	entries     map[string]*loginFailureEntry
+	// 期限切れのエントリを最後に掃除した時刻
+	prunedAt time.Time
+}
+
+type loginFailureEntry struct {
+	count   int
+	resetAt time.Time
+}
+
+func newLoginFailureLimiter(maxFailures int, window time.Duration) *loginFailureLimiter {
+	return &loginFailureLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		entries:     make(map[string]*loginFailureEntry),
+	}
+}
+
+// maxFailuresが0なら制限しない
+func (l *loginFailureLimiter) Blocked(key string) bool {
+	if l.maxFailures <= 0 {
+		return false
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(entry.resetAt) {
+		delete(l.entries, key)
+		return false
+	}
+	return entry.count >= l.maxFailures
+}
+
+func (l *loginFailureLimiter) RecordFailure(key string) {
+	if l.maxFailures <= 0 {
+		return
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	entry, ok := l.entries[key]
+	if !ok || now.After(entry.resetAt) {
+		// 全件の走査はwindowごとに1回だけにして、ランダムなキーが大量に来てもロックを長く握らない
+		if now.Sub(l.prunedAt) >= l.window {
+			l.pruneLocked(now)
+			l.prunedAt = now
+		}
+		entry = &loginFailureEntry{resetAt: now.Add(l.window)}
+		l.entries[key] = entry
+	}
+	entry.count++
+}
+
+func (l *loginFailureLimiter) Reset(key string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	delete(l.entries, key)
+}
+
+func (l *loginFailureLimiter) Clear() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.entries = make(map[string]*loginFailureEntry)
+}
+
+func (l *loginFailureLimiter) pruneLocked(now time.Time) {
+	for key, entry := range l.entries {
+		if now.After(entry.resetAt) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// 存在しないユーザでもbcryptの比較を行い、応答時間からユーザの存在が分からないようにする
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("isupipe-dummy-password"), bcryptDefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
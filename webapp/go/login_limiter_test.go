@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 期限切れのエントリはwindowごとにまとめて掃除し、新しいキーのたびには走査しない
+func TestLoginFailureLimiterPrune(t *testing.T) {
+	l := newLoginFailureLimiter(3, time.Minute)
+	for i := 0; i < 10; i++ {
+		l.RecordFailure(fmt.Sprintf("user:%d", i))
+	}
+	expired := time.Now().Add(-time.Second)
+	for _, entry := range l.entries {
+		entry.resetAt = expired
+	}
+
+	l.RecordFailure("user:new")
+	if got := len(l.entries); got != 11 {
+		t.Errorf("entries = %d, want 11 (pruned before window elapsed)", got)
+	}
+
+	l.prunedAt = time.Now().Add(-time.Minute)
+	l.RecordFailure("user:newer")
+	if got := len(l.entries); got != 2 {
+		t.Errorf("entries = %d, want 2 (expired entries should be pruned)", got)
+	}
+}
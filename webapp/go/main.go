@@ -4,34 +4,79 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	httppprof "net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
+	gommonbytes "github.com/labstack/gommon/bytes"
 	echolog "github.com/labstack/gommon/log"
 )
 
 const (
 	listenPort                     = 8080
+	listenPortEnvKey               = "ISUCON13_APP_PORT"
+	shutdownTimeout                = 10 * time.Second
+	healthCheckTimeout             = 1 * time.Second
+	isuDNSRollbackTimeout          = 3 * time.Second
+	gzipMinLength                  = 1024
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
 
-	isuDNSServer = "ISUCON13_ISUDNS_SERVER_ADDRESS"
+	isuDNSServer      = "ISUCON13_ISUDNS_SERVER_ADDRESS"
+	isuDNSTokenEnvKey = "ISUCON13_ISUDNS_TOKEN"
+	isuDNSTokenHeader = "X-Isudns-Token"
+
+	queryTimeoutEnvKey = "ISUCON13_QUERY_TIMEOUT_MS"
+
+	corsAllowOriginsEnvKey     = "ISUCON13_CORS_ALLOW_ORIGINS"
+	corsAllowCredentialsEnvKey = "ISUCON13_CORS_ALLOW_CREDENTIALS"
+
+	loginResponseWithExpiryEnvKey = "ISUCON13_LOGIN_RESPONSE_WITH_EXPIRY"
+	enforceReactionWindowEnvKey   = "ISUCON13_ENFORCE_REACTION_WINDOW"
+	enforceEnterWindowEnvKey      = "ISUCON13_ENFORCE_ENTER_WINDOW"
+	maxCommentLenEnvKey           = "ISUCON13_MAX_COMMENT_LEN"
+	idempotencyKeyTTLEnvKey       = "ISUCON13_IDEMPOTENCY_KEY_TTL_SEC"
+	loginMaxFailuresEnvKey        = "ISUCON13_LOGIN_MAX_FAILURES"
+	loginMaxFailuresPerIPEnvKey   = "ISUCON13_LOGIN_MAX_FAILURES_PER_IP"
+	loginFailureWindowEnvKey      = "ISUCON13_LOGIN_FAILURE_WINDOW_SEC"
+	trustForwardedForEnvKey       = "ISUCON13_TRUST_X_FORWARDED_FOR"
+	bodyLimitEnvKey               = "ISUCON13_BODY_LIMIT"
+	iconBodyLimitEnvKey           = "ISUCON13_ICON_BODY_LIMIT"
+	reactionSummaryTopKEnvKey     = "ISUCON13_REACTION_SUMMARY_TOP_K"
+	cookieDomainEnvKey            = "ISUCON13_COOKIE_DOMAIN"
+
+	defaultBodyLimit     = "1M"
+	defaultIconBodyLimit = "10M"
+
+	debugEnvKey          = "ISUCON13_DEBUG"
+	accessLogEnvKey      = "ISUCON13_ACCESS_LOG"
+	profileEnvKey        = "ISUCON13_PROFILE"
+	profileSecondsEnvKey = "ISUCON13_PROFILE_SECONDS"
+	profileDirEnvKey     = "ISUCON13_PROFILE_DIR"
+	profileKeepEnvKey    = "ISUCON13_PROFILE_KEEP"
 )
 
 var (
@@ -40,6 +85,49 @@ var (
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
 
 	isuDNSServerAddress string
+	isuDNSToken         string
+
+	// アイコン画像をハッシュ名で保存するディレクトリ
+	iconDir = "/home/isucon/icons"
+
+	// セッションCookieのドメイン (Cookieストアとログイン時の両方で使う)
+	// "*.u.isucon.dev" はCookieのDomainとして不正なので、ログイン時の値に揃えている
+	cookieDomain = "u.isucon.dev"
+
+	// リクエストごとのDBクエリのタイムアウト (0なら無効)
+	queryTimeout time.Duration
+
+	// ログインAPIのレスポンスにユーザ情報とセッションの有効期限を含めるか
+	loginResponseWithExpiry bool
+	// 配信期間外のライブ配信へのリアクションを拒否するか
+	// 過去の配信 (アーカイブ) へのリアクションを許す場合は ISUCON13_ENFORCE_REACTION_WINDOW=false で無効にする
+	enforceReactionWindow = true
+	// 配信期間外のライブ配信への入室を拒否するか
+	// 予約できる期間は過去の配信を含むので、既定では無効 (ISUCON13_ENFORCE_ENTER_WINDOW=true で有効)
+	enforceEnterWindow = false
+	// ライブコメントの最大文字数 (rune単位)
+	maxCommentLen = 140
+	// 予約APIのIdempotency-Keyの有効期間
+	idempotencyKeyTTL = 24 * time.Hour
+	// リアクション集計で個別に返す絵文字の数 (残りは other にまとめる)
+	reactionSummaryTopK = 10
+
+	// ログイン失敗回数の制限 (ユーザ名ごと・クライアントIPごと)
+	// ベンチマーカーは単一IPからアクセスするので、IPごとの制限はデフォルトでは無効
+	loginFailuresByUser = newLoginFailureLimiter(10, 5*time.Minute)
+	loginFailuresByIP   = newLoginFailureLimiter(0, 5*time.Minute)
+
+	// デバッグ用のAPIを有効にするか
+	debugEnabled bool
+	// アクセスログを出力するか (ベンチマーク時は無効にしておく)
+	accessLogEnabled bool
+
+	// initialize時にCPUプロファイルを取るか、またその時間
+	profileEnabled  bool
+	profileDuration = 70 * time.Second
+	// CPUプロファイルの出力先ディレクトリと、残しておくファイル数 (0なら無制限)
+	profileDir  = "/tmp"
+	profileKeep = 10
 )
 
 func init() {
@@ -47,34 +135,88 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	debugEnabled = os.Getenv(debugEnvKey) == "1"
+	accessLogEnabled = os.Getenv(accessLogEnvKey) == "1"
 }
 
 var cpuProfiler struct {
 	mtx sync.Mutex
 	f   *os.File
+	// 実行中のプロファイルの出力先
+	path string
+	// 実行中のプロファイルが停止されたときにcloseされる
+	done chan struct{}
 }
 
-func StartProfile() {
+// CPUプロファイルを開始する。すでに実行中のものは停止してから開始する
+// 出力先のパスと、このプロファイルが停止されたときにcloseされるchannelを返す
+// pprofの出力はgzip圧縮済みなので、さらに圧縮はしない
+func StartProfile() (string, <-chan struct{}, error) {
 	cpuProfiler.mtx.Lock()
 	defer cpuProfiler.mtx.Unlock()
-	if cpuProfiler.f != nil {
-		if err := cpuProfiler.f.Close(); err != nil {
-			log.Printf("failed to close profile file: %v", err)
-		}
+	stopProfileLocked()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create profile directory: %w", err)
 	}
-	pprof.StopCPUProfile()
-	var err error
-	cpuProfiler.f, err = os.Create(fmt.Sprintf("/tmp/profile-%s.pprof", time.Now().Format("20060102-15:04:05")))
+	// これから作る分を含めて profileKeep 個に収まるよう、古いものから消しておく
+	if profileKeep > 0 {
+		pruneProfiles(profileKeep - 1)
+	}
+	path := filepath.Join(profileDir, fmt.Sprintf("profile-%s.pprof", time.Now().Format("20060102-15:04:05")))
+	f, err := os.Create(path)
 	if err != nil {
-		log.Printf("failed to create profile file: %v", err)
+		return "", nil, fmt.Errorf("failed to create profile file: %w", err)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return "", nil, fmt.Errorf("failed to start cpu profile: %w", err)
+	}
+	cpuProfiler.f = f
+	cpuProfiler.path = path
+	cpuProfiler.done = make(chan struct{})
+	return path, cpuProfiler.done, nil
+}
+
+// 出力先ディレクトリのプロファイルを新しいものから keep 個だけ残して削除する
+// ファイル名の時刻は辞書順に並べれば古い順になる
+func pruneProfiles(keep int) {
+	paths, err := filepath.Glob(filepath.Join(profileDir, "profile-*.pprof"))
+	if err != nil || len(paths) <= keep {
 		return
 	}
-	pprof.StartCPUProfile(cpuProfiler.f)
+	sort.Strings(paths)
+	for _, path := range paths[:len(paths)-keep] {
+		if err := os.Remove(path); err != nil {
+			log.Printf("failed to remove old profile file: %v", err)
+		}
+	}
+}
+
+// CPUプロファイルを停止して、出力先のパスを返す。実行中でなければ空文字を返す
+func StopProfile() string {
+	cpuProfiler.mtx.Lock()
+	defer cpuProfiler.mtx.Unlock()
+	return stopProfileLocked()
 }
 
-func StopProfile() {
+// 指定時間後にプロファイルを停止する
+// 途中で別のプロファイルが開始された場合は、そちらを止めないようにする
+func stopProfileAfter(done <-chan struct{}, d time.Duration) {
+	select {
+	case <-done:
+		return
+	case <-time.After(d):
+	}
+
 	cpuProfiler.mtx.Lock()
 	defer cpuProfiler.mtx.Unlock()
+	if cpuProfiler.done != nil && cpuProfiler.done == done {
+		stopProfileLocked()
+	}
+}
+
+func stopProfileLocked() string {
+	path := cpuProfiler.path
 	pprof.StopCPUProfile()
 	if cpuProfiler.f != nil {
 		if err := cpuProfiler.f.Close(); err != nil {
@@ -82,6 +224,143 @@ func StopProfile() {
 		}
 	}
 	cpuProfiler.f = nil
+	cpuProfiler.path = ""
+	if cpuProfiler.done != nil {
+		close(cpuProfiler.done)
+		cpuProfiler.done = nil
+	}
+	return path
+}
+
+// 環境変数でオリジンが指定されていない場合はCORSを無効にする (同一オリジンのみ)
+func corsConfig() (middleware.CORSConfig, bool, error) {
+	v, ok := os.LookupEnv(corsAllowOriginsEnvKey)
+	if !ok || v == "" {
+		return middleware.CORSConfig{}, false, nil
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(v, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	allowCredentials := false
+	if v, ok := os.LookupEnv(corsAllowCredentialsEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return middleware.CORSConfig{}, false, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", corsAllowCredentialsEnvKey, err)
+		}
+		allowCredentials = b
+	}
+
+	return middleware.CORSConfig{
+		AllowOrigins:     origins,
+		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+		AllowHeaders:     []string{echo.HeaderContentType, "If-None-Match", idempotencyKeyHeader},
+		AllowCredentials: allowCredentials,
+	}, true, nil
+}
+
+// クライアントのIPアドレスの取り出し方
+// 既定では接続元のアドレスを使い、クライアントが送ったX-Forwarded-Forは信用しない
+// 同じホストのリバースプロキシを経由する場合のみ、プロキシが付けたX-Forwarded-Forを使う
+func ipExtractorFromEnv() (echo.IPExtractor, error) {
+	v, ok := os.LookupEnv(trustForwardedForEnvKey)
+	if !ok {
+		return echo.ExtractIPDirect(), nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", trustForwardedForEnvKey, err)
+	}
+	if !b {
+		return echo.ExtractIPDirect(), nil
+	}
+	return echo.ExtractIPFromXFFHeader(echo.TrustLoopback(true), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)), nil
+}
+
+func gzipConfig() middleware.GzipConfig {
+	return middleware.GzipConfig{
+		// 小さいレスポンスは圧縮しても得にならない
+		MinLength: gzipMinLength,
+		Skipper: func(c echo.Context) bool {
+			// 画像は圧縮済み、WebSocketはHijackするため対象外
+			switch c.Path() {
+			case "/api/user/:username/icon":
+				return c.Request().Method == http.MethodGet
+			case "/api/livestream/:livestream_id/livecomment/ws":
+				return true
+			}
+			return false
+		},
+	}
+}
+
+// アイコン以外のリクエストボディの上限
+// アイコンはルートごとに別の上限を設定する
+func bodyLimitMiddleware(limit string) echo.MiddlewareFunc {
+	return middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/api/icon"
+		},
+		Limit: limit,
+	})
+}
+
+// リクエストのcontextにタイムアウトを設定するミドルウェア
+// ハンドラは c.Request().Context() でトランザクションを開始しているので、
+// 期限を過ぎるとクエリがキャンセルされ、defer tx.Rollback() で接続が解放される
+// 初期化は時間がかかり、WebSocketは接続を維持し続けるので対象外
+func queryTimeoutMiddleware(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Path() {
+			case "/api/initialize", "/api/livestream/:livestream_id/livecomment/ws":
+				return next(c)
+			}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+type AccessLog struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// 1リクエストにつき1行のJSONでアクセスログを出力するミドルウェア
+// リクエストボディは出力しない
+func accessLogMiddleware() echo.MiddlewareFunc {
+	enc := json.NewEncoder(os.Stdout)
+	var mtx sync.Mutex
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogLatency:   true,
+		LogMethod:    true,
+		LogURIPath:   true,
+		LogRequestID: true,
+		LogStatus:    true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return enc.Encode(&AccessLog{
+				Time:      v.StartTime.Format(time.RFC3339Nano),
+				RequestID: v.RequestID,
+				Method:    v.Method,
+				Path:      v.URIPath,
+				Status:    v.Status,
+				LatencyMs: float64(v.Latency.Microseconds()) / 1000,
+			})
+		},
+	})
 }
 
 type InitializeResponse struct {
@@ -97,6 +376,13 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
 		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+
+		connectAttemptsEnvKey = "ISUCON13_MYSQL_CONNECT_ATTEMPTS"
+		connectBackoffEnvKey  = "ISUCON13_MYSQL_CONNECT_BACKOFF_MS"
+
+		maxOpenConnsEnvKey    = "ISUCON13_DB_MAX_OPEN"
+		maxIdleConnsEnvKey    = "ISUCON13_DB_MAX_IDLE"
+		connMaxLifetimeEnvKey = "ISUCON13_DB_CONN_MAX_LIFETIME_SEC"
 	)
 
 	conf := mysql.NewConfig()
@@ -142,19 +428,122 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(400)
-	db.SetMaxIdleConns(400)
+	// MySQLの再起動後に切れた接続を使い続けないよう、接続は一定時間で作り直す
+	maxOpenConns, maxIdleConns, connMaxLifetime := 400, 400, 5*time.Minute
+	if v, ok := os.LookupEnv(maxOpenConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", maxOpenConnsEnvKey, v)
+		}
+		maxOpenConns = n
+	}
+	if v, ok := os.LookupEnv(maxIdleConnsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", maxIdleConnsEnvKey, v)
+		}
+		maxIdleConns = n
+	}
+	if v, ok := os.LookupEnv(connMaxLifetimeEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", connMaxLifetimeEnvKey, v)
+		}
+		connMaxLifetime = time.Duration(sec) * time.Second
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
 
-	if err := db.Ping(); err != nil {
-		return nil, err
+	// DBの起動が遅れても落ちないよう、一定回数までPingをリトライする
+	attempts, backoff := 10, 1*time.Second
+	if v, ok := os.LookupEnv(connectAttemptsEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("environment variable '%s' must be positive integer: %s", connectAttemptsEnvKey, v)
+		}
+		attempts = n
+	}
+	if v, ok := os.LookupEnv(connectBackoffEnvKey); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("environment variable '%s' must be non-negative integer: %s", connectBackoffEnvKey, v)
+		}
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	for i := 1; ; i++ {
+		err := db.Ping()
+		if err == nil {
+			break
+		}
+		if i >= attempts {
+			db.Close()
+			return nil, err
+		}
+		logger.Warnf("failed to ping db (attempt %d/%d), retrying in %s: %v", i, attempts, backoff, err)
+		time.Sleep(backoff)
 	}
 
 	return db, nil
 }
 
+// 配信者ごとの集計値 (reactions, tips, live_comments) を再計算するクエリ
+// 特定のユーザだけ再計算する場合は WHERE u.id = ? を付ける
+const recomputeUserCountersQuery = `
+	UPDATE users u
+	LEFT JOIN (
+		SELECT l.user_id, COUNT(*) AS reactions FROM livestreams l
+		INNER JOIN reactions r ON r.livestream_id = l.id
+		GROUP BY l.user_id
+	) r ON r.user_id = u.id
+	LEFT JOIN (
+		SELECT l.user_id, SUM(c.tip) AS tips, COUNT(*) AS live_comments FROM livestreams l
+		INNER JOIN livecomments c ON c.livestream_id = l.id
+		GROUP BY l.user_id
+	) c ON c.user_id = u.id
+	SET u.reactions = IFNULL(r.reactions, 0), u.tips = IFNULL(c.tips, 0), u.live_comments = IFNULL(c.live_comments, 0)`
+
+// 配信ごとの集計値 (reactions, tips, max_tip) を再計算するクエリ
+const recomputeLivestreamCountersQuery = `
+	UPDATE livestreams l
+	LEFT JOIN (
+		SELECT livestream_id, COUNT(*) AS reactions FROM reactions
+		GROUP BY livestream_id
+	) r ON r.livestream_id = l.id
+	LEFT JOIN (
+		SELECT livestream_id, SUM(tip) AS tips, MAX(tip) AS max_tip FROM livecomments
+		GROUP BY livestream_id
+	) c ON c.livestream_id = l.id
+	SET l.reactions = IFNULL(r.reactions, 0), l.tips = IFNULL(c.tips, 0), l.max_tip = IFNULL(c.max_tip, 0)`
+
+// 全ユーザを userCache と iconCache に載せる
+func warmUserCache(ctx context.Context) error {
+	var users []*UserModel
+	if err := dbConn.SelectContext(ctx, &users, "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users"); err != nil {
+		return err
+	}
+	for _, userModel := range users {
+		userCache.Set(fmt.Sprintf("id:%d", userModel.ID), userModel)
+		userCache.Set(fmt.Sprintf("name:%s", userModel.Name), userModel)
+		iconCache.Set(userModel.Name, userModel.IconHash)
+	}
+	return nil
+}
+
 func initializeHandler(c echo.Context) error {
 	userCache.Clear()
 	iconCache.Clear()
+	webpIconCache.Clear()
+	iconThumbnailCache.Clear()
+	popularEmojiCache.Clear()
+	trendingEmojiCache.Clear()
+	trendingLivestreamCache.Clear()
+	livestreamTagsCache.Clear()
+	statsOverviewCache.Clear()
+	paymentCache.Clear()
+	resetRankingCache()
+	loginFailuresByUser.Clear()
+	loginFailuresByIP.Clear()
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
@@ -166,105 +555,121 @@ func initializeHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
-	var users []*UserModel
-	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
-	}
+	defer tx.Rollback()
 
-	for _, user := range users {
-		var reactions int64
-		query := `
-		SELECT COUNT(*) FROM users u
-		INNER JOIN livestreams l ON l.user_id = u.id
-		INNER JOIN reactions r ON r.livestream_id = l.id
-		WHERE u.id = ?`
-		if err := tx.GetContext(ctx, &reactions, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
-		}
-
-		if _, err := tx.ExecContext(ctx, "UPDATE users SET reactions = ? WHERE id = ?", reactions, user.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reactions: "+err.Error())
-		}
-
-		var tips int64
-		query = `
-		SELECT IFNULL(SUM(l2.tip), 0) FROM users u
-		INNER JOIN livestreams l ON l.user_id = u.id	
-		INNER JOIN livecomments l2 ON l2.livestream_id = l.id
-		WHERE u.id = ?`
-		if err := tx.GetContext(ctx, &tips, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
-		}
-
-		if _, err := tx.ExecContext(ctx, "UPDATE users SET tips = ? WHERE id = ?", tips, user.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tips: "+err.Error())
-		}
-
-		var live_comments int64
-		if err := tx.GetContext(ctx, &live_comments, "SELECT COUNT(*) FROM users u INNER JOIN livestreams l ON l.user_id = u.id INNER JOIN livecomments c ON c.livestream_id = l.id WHERE u.id = ?", user.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get live_comments: "+err.Error())
-		}
-		if _, err := tx.ExecContext(ctx, "UPDATE users SET live_comments = ? WHERE id = ?", live_comments, user.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update live_comments: "+err.Error())
-		}
+	// 配信者ごとの集計値をまとめて更新する
+	if _, err := tx.ExecContext(ctx, recomputeUserCountersQuery); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user counters: "+err.Error())
 	}
 
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	// 配信ごとの集計値をまとめて更新する
+	if _, err := tx.ExecContext(ctx, recomputeLivestreamCountersQuery); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream counters: "+err.Error())
 	}
 
-	for _, livestream := range livestreams {
-		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
-		}
-
-		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET reactions = ? WHERE id = ?", reactions, livestream.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream reactions: "+err.Error())
-		}
-
-		var totalTips int64
-		if err := tx.GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to counttips: "+err.Error())
-		}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
 
-		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET tips = ? WHERE id = ?", totalTips, livestream.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tips: "+err.Error())
-		}
+	if err := loadTags(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
 
-		var maxTip int64
-		if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
-		}
+	// 初期化直後のリクエストがDBに殺到しないよう、ユーザのキャッシュを温めておく
+	if err := warmUserCache(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
 
-		if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET max_tip = ? WHERE id = ?", maxTip, livestream.ID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update maximum tip livecomment: "+err.Error())
+	if profileEnabled {
+		if _, done, err := StartProfile(); err != nil {
+			c.Logger().Warnf("failed to start profile: %v", err)
+		} else {
+			go stopProfileAfter(done, profileDuration)
 		}
 	}
 
-	tx.Commit()
-
-	StartProfile()
-
-	go func() {
-		time.Sleep(70 * time.Second)
-		StopProfile()
-	}()
-
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
 	})
 }
 
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ヘルスチェックAPI
+// GET /api/health
+func healthHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := dbConn.PingContext(ctx); err != nil {
+		c.Logger().Warnf("health check failed: %v", err)
+		return c.JSON(http.StatusServiceUnavailable, &HealthResponse{Status: "db_unavailable"})
+	}
+	return c.JSON(http.StatusOK, &HealthResponse{Status: "ok"})
+}
+
 type JSONSerializer struct{}
 
 func (j *JSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
 	enc := json.NewEncoder(c.Response())
+	if c.Request().Method == http.MethodGet && c.QueryParam("time_format") == "rfc3339" {
+		shaped, err := formatTimestampsRFC3339(i)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(shaped)
+	}
 	return enc.Encode(i)
 }
 
+// ?time_format=rfc3339 のときに RFC3339 の文字列にするフィールド
+var timestampFields = map[string]struct{}{
+	"start_at":   {},
+	"end_at":     {},
+	"created_at": {},
+	"expires_at": {},
+}
+
+// レスポンスを一度汎用的な形に変換し、unix秒のフィールドをRFC3339の文字列に置き換える
+func formatTimestampsRFC3339(i interface{}) (interface{}, error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return replaceTimestamps(v), nil
+}
+
+func replaceTimestamps(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if n, ok := value.(json.Number); ok {
+				if _, ok := timestampFields[key]; ok {
+					if sec, err := n.Int64(); err == nil {
+						v[key] = time.Unix(sec, 0).UTC().Format(time.RFC3339)
+					}
+					continue
+				}
+			}
+			v[key] = replaceTimestamps(value)
+		}
+	case []interface{}:
+		for idx := range v {
+			v[idx] = replaceTimestamps(v[idx])
+		}
+	}
+	return v
+}
+
 func (j *JSONSerializer) Deserialize(c echo.Context, i interface{}) error {
 	err := json.NewDecoder(c.Request().Body).Decode(i)
 	if ute, ok := err.(*json.UnmarshalTypeError); ok {
@@ -274,43 +679,123 @@ func (j *JSONSerializer) Deserialize(c echo.Context, i interface{}) error {
 	}
 	return err
 }
+
+// リクエストボディのJSONをデコードする
+// 型・構文エラーの場合は Deserialize と同じく、問題のあるフィールドや位置を含む400を返す
+func decodeRequestBody(c echo.Context, i interface{}) error {
+	err := c.Echo().JSONSerializer.Deserialize(c, i)
+	if err == nil {
+		return nil
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return err
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json: "+err.Error()).SetInternal(err)
+}
+
 func main() {
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.ERROR)
 	e.JSONSerializer = &JSONSerializer{}
-	// e.Use(middleware.Logger())
+	ipExtractor, err := ipExtractorFromEnv()
+	if err != nil {
+		e.Logger.Errorf("failed to configure IP extractor: %v", err)
+		os.Exit(1)
+	}
+	e.IPExtractor = ipExtractor
+	if accessLogEnabled {
+		e.Use(middleware.RequestID())
+		e.Use(accessLogMiddleware())
+	}
+	if debugEnabled {
+		e.Use(metricsMiddleware)
+	}
+	// リクエストボディの上限 (超えた場合は413)
+	// アイコンはbase64の画像を含むので別に上限を設ける
+	bodyLimit, iconBodyLimit := defaultBodyLimit, defaultIconBodyLimit
+	for envKey, limit := range map[string]*string{
+		bodyLimitEnvKey:     &bodyLimit,
+		iconBodyLimitEnvKey: &iconBodyLimit,
+	} {
+		if v, ok := os.LookupEnv(envKey); ok {
+			if _, err := gommonbytes.Parse(v); err != nil {
+				e.Logger.Errorf("environment variable '%s' must be size like 1M: %s", envKey, v)
+				os.Exit(1)
+			}
+			*limit = v
+		}
+	}
+	e.Use(bodyLimitMiddleware(bodyLimit))
+	e.Use(middleware.GzipWithConfig(gzipConfig()))
+	if v, ok := os.LookupEnv(queryTimeoutEnvKey); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			e.Logger.Errorf("environment variable '%s' must be non-negative integer: %s", queryTimeoutEnvKey, v)
+			os.Exit(1)
+		}
+		queryTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if queryTimeout > 0 {
+		e.Use(queryTimeoutMiddleware(queryTimeout))
+	}
+	cors, enabled, err := corsConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to configure CORS: %v", err)
+		os.Exit(1)
+	}
+	if enabled {
+		e.Use(middleware.CORSWithConfig(cors))
+	}
 	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.dev"
+	if v, ok := os.LookupEnv(cookieDomainEnvKey); ok {
+		cookieDomain = v
+	}
+	cookieStore.Options.Domain = cookieDomain
 	e.Use(session.Middleware(cookieStore))
 	// e.Use(middleware.Recover())
 
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
+	e.GET("/api/health", healthHandler)
 
 	// top
 	e.GET("/api/tag", getTagHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	e.GET("/api/themes", getThemesHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/trending", getTrendingLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	e.GET("/api/user/:username/livestreams/upcoming", getUserUpcomingLivestreamsHandler)
+	e.GET("/api/user/:username/livestreams/past", getUserPastLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/ws", livecommentStreamHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	e.DELETE("/api/livestream/:livestream_id/livecomment/:livecomment_id", deleteLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
+	e.POST("/api/livestream/:livestream_id/reactions", postBulkReactionsHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/reaction/:reaction_id", getReactionHandler)
+	e.DELETE("/api/livestream/:livestream_id/reaction/:reaction_id", deleteReactionHandler)
+	e.GET("/api/livestream/:livestream_id/reaction/timeline", getReactionTimelineHandler)
+	e.GET("/api/livestream/:livestream_id/reaction/summary", getReactionSummaryHandler)
+	e.GET("/api/livestream/:livestream_id/reaction/count", getReactionCountHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
+	e.GET("/api/livestream/:livestream_id/ngwords/usage", getNgwordsUsage)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
@@ -321,24 +806,49 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// ユーザ視聴中 (viewer)
+	e.POST("/api/livestream/:livestream_id/heartbeat", postViewerHeartbeatHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.GET("/api/user/me/dns/status", getMyDNSStatusHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
+	e.GET("/api/user/search", searchUsersHandler)
 	e.GET("/api/user/:username", getUserHandler)
+	e.GET("/api/user/id/:user_id", getUserByIDHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	e.GET("/api/user/:username/favorite-emojis", getUserFavoriteEmojisHandler)
+	e.GET("/api/user/:username/tags", getUserTagsHandler)
+	e.POST("/api/user/statistics/batch", postUserStatisticsBatchHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	e.POST("/api/icon", postIconHandler, middleware.BodyLimit(iconBodyLimit))
+	e.DELETE("/api/user/:username/icon", deleteIconHandler)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/emoji/popular", getPopularEmojisHandler)
+	e.GET("/api/emoji/trending", getTrendingEmojisHandler)
+	e.GET("/api/stats/overview", getStatsOverviewHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
 
+	// デバッグ用 (ISUCON13_DEBUG=1 のときのみ)
+	if debugEnabled {
+		e.POST("/api/debug/profile/start", startProfileHandler)
+		e.POST("/api/debug/profile/stop", stopProfileHandler)
+		e.POST("/api/admin/recompute/user/:username", recomputeUserCountersHandler)
+
+		e.GET("/debug/pprof/*", echo.WrapHandler(http.HandlerFunc(httppprof.Index)))
+		e.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(httppprof.Cmdline)))
+		e.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(httppprof.Profile)))
+		e.Any("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(httppprof.Symbol)))
+		e.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(httppprof.Trace)))
+	}
+
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
@@ -347,9 +857,22 @@ func main() {
 		e.Logger.Errorf("failed to connect db: %v", err)
 		os.Exit(1)
 	}
-	defer conn.Close()
+	defer func() {
+		if err := conn.Close(); err != nil {
+			e.Logger.Errorf("failed to close db: %v", err)
+		}
+	}()
 	dbConn = conn
 
+	if err := loadTags(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load tags: %v", err)
+		os.Exit(1)
+	}
+
+	if debugEnabled {
+		e.GET("/metrics", metricsHandler(newMetricsRegistry(dbConn)))
+	}
+
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
 		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
@@ -363,29 +886,159 @@ func main() {
 		os.Exit(1)
 	}
 	isuDNSServerAddress = isuDNSServerAddr
+	isuDNSToken = os.Getenv(isuDNSTokenEnvKey)
+
+	if v, ok := os.LookupEnv(loginResponseWithExpiryEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.Logger.Errorf("failed to parse environment variable '%s' as bool: %+v", loginResponseWithExpiryEnvKey, err)
+			os.Exit(1)
+		}
+		loginResponseWithExpiry = b
+	}
+
+	if v, ok := os.LookupEnv(enforceReactionWindowEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.Logger.Errorf("failed to parse environment variable '%s' as bool: %+v", enforceReactionWindowEnvKey, err)
+			os.Exit(1)
+		}
+		enforceReactionWindow = b
+	}
+	if v, ok := os.LookupEnv(enforceEnterWindowEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.Logger.Errorf("failed to parse environment variable '%s' as bool: %+v", enforceEnterWindowEnvKey, err)
+			os.Exit(1)
+		}
+		enforceEnterWindow = b
+	}
+
+	if v, ok := os.LookupEnv(maxCommentLenEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			e.Logger.Errorf("environment variable '%s' must be positive integer: %s", maxCommentLenEnvKey, v)
+			os.Exit(1)
+		}
+		maxCommentLen = n
+	}
+
+	if v, ok := os.LookupEnv(idempotencyKeyTTLEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			e.Logger.Errorf("environment variable '%s' must be positive integer: %s", idempotencyKeyTTLEnvKey, v)
+			os.Exit(1)
+		}
+		idempotencyKeyTTL = time.Duration(sec) * time.Second
+	}
+
+	if v, ok := os.LookupEnv(reactionSummaryTopKEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			e.Logger.Errorf("environment variable '%s' must be positive integer: %s", reactionSummaryTopKEnvKey, v)
+			os.Exit(1)
+		}
+		reactionSummaryTopK = n
+	}
+
+	for envKey, limiter := range map[string]*loginFailureLimiter{
+		loginMaxFailuresEnvKey:      loginFailuresByUser,
+		loginMaxFailuresPerIPEnvKey: loginFailuresByIP,
+	} {
+		if v, ok := os.LookupEnv(envKey); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				e.Logger.Errorf("environment variable '%s' must be non-negative integer: %s", envKey, v)
+				os.Exit(1)
+			}
+			limiter.maxFailures = n
+		}
+	}
+	if v, ok := os.LookupEnv(loginFailureWindowEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			e.Logger.Errorf("environment variable '%s' must be positive integer: %s", loginFailureWindowEnvKey, v)
+			os.Exit(1)
+		}
+		loginFailuresByUser.window = time.Duration(sec) * time.Second
+		loginFailuresByIP.window = time.Duration(sec) * time.Second
+	}
+
+	profileEnabled = os.Getenv(profileEnvKey) == "1"
+	if v, ok := os.LookupEnv(profileSecondsEnvKey); ok {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 {
+			e.Logger.Errorf("environment variable '%s' must be positive integer: %s", profileSecondsEnvKey, v)
+			os.Exit(1)
+		}
+		profileDuration = time.Duration(sec) * time.Second
+	}
+	if v, ok := os.LookupEnv(profileDirEnvKey); ok {
+		if v == "" {
+			e.Logger.Errorf("environment variable '%s' must not be empty", profileDirEnvKey)
+			os.Exit(1)
+		}
+		profileDir = v
+	}
+	if v, ok := os.LookupEnv(profileKeepEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			e.Logger.Errorf("environment variable '%s' must be non-negative integer: %s", profileKeepEnvKey, v)
+			os.Exit(1)
+		}
+		profileKeep = n
+	}
+
+	port := listenPort
+	if v, ok := os.LookupEnv(listenPortEnvKey); ok {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > 65535 {
+			e.Logger.Errorf("failed to parse environment variable '%s' as port number: %s", listenPortEnvKey, v)
+			os.Exit(1)
+		}
+		port = p
+	}
 
 	// HTTPサーバ起動
-	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
-		e.Logger.Errorf("failed to start HTTP server: %v", err)
-		os.Exit(1)
+	listenAddr := net.JoinHostPort("", strconv.Itoa(port))
+	go func() {
+		if err := e.Start(listenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Errorf("failed to start HTTP server: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// SIGINT/SIGTERMを受けたら処理中のリクエストを待ってから終了する
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		e.Logger.Errorf("failed to shutdown HTTP server: %v", err)
 	}
+	StopProfile()
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code"`
+	// バリデーションエラーの場合のみ、問題のあるフィールドを列挙する
+	Fields []FieldError `json:"fields,omitempty"`
+	// 予約枠が埋まっていた場合のみ、その枠を列挙する
+	UnavailableSlots []ReservationSlotRange `json:"unavailable_slots,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
-	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
-			c.Logger().Errorf("%+v", e)
-		}
-		return
-	}
-
-	if e := c.JSON(http.StatusInternalServerError, &ErrorResponse{Error: err.Error()}); e != nil {
+	status, res := newErrorResponse(err)
+	if e := c.JSON(status, res); e != nil {
 		c.Logger().Errorf("%+v", e)
 	}
 }
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// テスト用のヘルパー
+// DBはsqlmockに差し替え、ハンドラは echo.Context を直接作って呼び出す
+
+// dbConn をsqlmockに差し替える。テスト終了時に期待したクエリがすべて実行されたかを確認する
+func setupMockDB(t testing.TB) sqlmock.Sqlmock {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	prev := dbConn
+	dbConn = sqlx.NewDb(db, "mysql")
+	resetCachesForTest()
+
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unfulfilled expectations: %v", err)
+		}
+		dbConn.Close()
+		dbConn = prev
+		resetCachesForTest()
+	})
+	return mock
+}
+
+// テスト間でキャッシュの状態が漏れないようにする
+func resetCachesForTest() {
+	userCache.Clear()
+	iconCache.Clear()
+	webpIconCache.Clear()
+	iconThumbnailCache.Clear()
+	popularEmojiCache.Clear()
+	trendingEmojiCache.Clear()
+	trendingLivestreamCache.Clear()
+	livestreamTagsCache.Clear()
+	statsOverviewCache.Clear()
+	paymentCache.Clear()
+	resetRankingCache()
+	loginFailuresByUser.Clear()
+	loginFailuresByIP.Clear()
+}
+
+// 固定の値を返すセッションストア
+// values が nil なら未ログインとして新しいセッションを返す
+type testSessionStore struct {
+	values map[interface{}]interface{}
+}
+
+func (s *testSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *testSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	sess.Options = &sessions.Options{Path: "/"}
+	sess.IsNew = s.values == nil
+	for k, v := range s.values {
+		sess.Values[k] = v
+	}
+	return sess, nil
+}
+
+func (s *testSessionStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	return nil
+}
+
+func newTestContext(method, target string, body io.Reader) (echo.Context, *httptest.ResponseRecorder) {
+	e := echo.New()
+	e.JSONSerializer = &JSONSerializer{}
+	req := httptest.NewRequest(method, target, body)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("_session_store", &testSessionStore{})
+	return c, rec
+}
+
+// 有効期限内のログインセッションを持たせる
+func withLoginSession(c echo.Context, userID int64, username string) {
+	c.Set("_session_store", &testSessionStore{values: map[interface{}]interface{}{
+		defaultSessionIDKey:      "test-session",
+		defaultUserIDKey:         userID,
+		defaultUsernameKey:       username,
+		defaultSessionExpiresKey: time.Now().Add(time.Hour).Unix(),
+	}})
+}
+
+func withParams(c echo.Context, kv ...string) {
+	names := make([]string, 0, len(kv)/2)
+	values := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		names = append(names, kv[i])
+		values = append(values, kv[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+}
+
+// DBを引かずに済むよう、ユーザをキャッシュに入れておく
+func cacheUserForTest(u *UserModel) {
+	userCache.Set(fmt.Sprintf("id:%d", u.ID), u)
+	userCache.Set(fmt.Sprintf("name:%s", u.Name), u)
+	iconCache.Set(u.Name, u.IconHash)
+}
+
+// ハンドラの戻り値とレスポンスからステータスコードを取り出す
+func statusOf(err error, rec *httptest.ResponseRecorder) int {
+	if err == nil {
+		return rec.Code
+	}
+	status, _ := resolveErrorCode(err)
+	return status
+}
+
+// ユーザ取得クエリの結果
+func userRows(users ...UserModel) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "name", "display_name", "description", "password", "dark_mode", "icon_hash"})
+	for _, u := range users {
+		rows.AddRow(u.ID, u.Name, u.DisplayName, u.Description, u.HashedPassword, u.DarkMode, u.IconHash)
+	}
+	return rows
+}
+
+func TestPruneProfiles(t *testing.T) {
+	dir := t.TempDir()
+	prev := profileDir
+	profileDir = dir
+	t.Cleanup(func() { profileDir = prev })
+
+	names := []string{
+		"profile-20231125-10:00:00.pprof",
+		"profile-20231125-11:00:00.pprof",
+		"profile-20231126-09:00:00.pprof",
+		"profile-20231127-08:00:00.pprof",
+		"unrelated.txt",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneProfiles(2)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	// 新しい2つとプロファイル以外のファイルが残る
+	want := []string{"profile-20231126-09:00:00.pprof", "profile-20231127-08:00:00.pprof", "unrelated.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	t.Setenv(corsAllowOriginsEnvKey, "http://localhost:3000, https://dev.u.isucon.dev")
+	t.Setenv(corsAllowCredentialsEnvKey, "true")
+	cors, enabled, err := corsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Fatal("CORS is disabled")
+	}
+
+	e := echo.New()
+	e.Use(middleware.CORSWithConfig(cors))
+	e.GET("/api/tag", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	tests := []struct {
+		name   string
+		method string
+		origin string
+		allow  string
+	}{
+		{"allowed", http.MethodGet, "http://localhost:3000", "http://localhost:3000"},
+		{"allowed preflight", http.MethodOptions, "https://dev.u.isucon.dev", "https://dev.u.isucon.dev"},
+		{"disallowed", http.MethodGet, "https://evil.example.com", ""},
+		{"disallowed preflight", http.MethodOptions, "https://evil.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/tag", nil)
+			req.Header.Set(echo.HeaderOrigin, tt.origin)
+			if tt.method == http.MethodOptions {
+				req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			wantCredentials := ""
+			if tt.allow != "" {
+				wantCredentials = "true"
+			}
+			if got := rec.Header().Get(echo.HeaderAccessControlAllowCredentials); got != wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, wantCredentials)
+			}
+			if tt.method == http.MethodOptions && tt.allow != "" && rec.Code != http.StatusNoContent {
+				t.Errorf("preflight status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+		})
+	}
+}
+
+// 既定ではクライアントが送ったX-Forwarded-Forを使わない
+func TestIPExtractor(t *testing.T) {
+	cases := []struct {
+		name string
+		env  string
+		set  bool
+		xff  string
+		want string
+	}{
+		{"default ignores header", "", false, "203.0.113.1", "192.0.2.1"},
+		{"disabled ignores header", "false", true, "203.0.113.1", "192.0.2.1"},
+		// プロキシが末尾に付けた接続元を使い、クライアントが偽装した先頭の値は使わない
+		{"trusted proxy", "true", true, "203.0.113.1, 198.51.100.2", "198.51.100.2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.set {
+				t.Setenv(trustForwardedForEnvKey, tc.env)
+			}
+			extractor, err := ipExtractorFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+			req.Header.Set(echo.HeaderXForwardedFor, tc.xff)
+			if tc.env == "true" {
+				req.RemoteAddr = "127.0.0.1:12345"
+			}
+			if got := extractor(req); got != tc.want {
+				t.Errorf("ip = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	t.Setenv(corsAllowOriginsEnvKey, "")
+	if _, enabled, err := corsConfig(); err != nil || enabled {
+		t.Errorf("corsConfig() enabled = %v, err = %v, want disabled", enabled, err)
+	}
+}
+
+type counterRow struct {
+	ID           int64 `db:"id"`
+	Reactions    int64 `db:"reactions"`
+	Tips         int64 `db:"tips"`
+	LiveComments int64 `db:"live_comments"`
+	MaxTip       int64 `db:"max_tip"`
+}
+
+// 集計値を1行ずつ求める、set-basedなUPDATEに置き換える前の計算
+func legacyCounters(t *testing.T, db *sqlx.DB) (users, livestreams []counterRow) {
+	t.Helper()
+	var userIDs, livestreamIDs []int64
+	if err := db.Select(&userIDs, "SELECT id FROM users ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Select(&livestreamIDs, "SELECT id FROM livestreams ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	get := func(query string, id int64) int64 {
+		var v int64
+		if err := db.Get(&v, query, id); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, id := range userIDs {
+		users = append(users, counterRow{
+			ID:           id,
+			Reactions:    get("SELECT COUNT(*) FROM users u INNER JOIN livestreams l ON l.user_id = u.id INNER JOIN reactions r ON r.livestream_id = l.id WHERE u.id = ?", id),
+			Tips:         get("SELECT IFNULL(SUM(l2.tip), 0) FROM users u INNER JOIN livestreams l ON l.user_id = u.id INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE u.id = ?", id),
+			LiveComments: get("SELECT COUNT(*) FROM users u INNER JOIN livestreams l ON l.user_id = u.id INNER JOIN livecomments c ON c.livestream_id = l.id WHERE u.id = ?", id),
+		})
+	}
+	for _, id := range livestreamIDs {
+		livestreams = append(livestreams, counterRow{
+			ID:        id,
+			Reactions: get("SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", id),
+			Tips:      get("SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", id),
+			MaxTip:    get("SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?", id),
+		})
+	}
+	return users, livestreams
+}
+
+func TestRecomputeCountersMatchesLegacy(t *testing.T) {
+	db := setupTestMySQL(t)
+
+	execForTest(t, db,
+		// carol は配信していない
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'alice', '', '', ''), (2, 'bob', '', '', ''), (3, 'carol', '', '', '')",
+		// 12 はコメントもリアクションもない配信
+		"INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, 0), (11, 1, '', '', '', '', 0, 0), (12, 2, '', '', '', '', 0, 0), (13, 2, '', '', '', '', 0, 0)",
+		"INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (2, 10, 'a', 0), (3, 10, 'b', 0), (3, 11, 'a', 0), (1, 13, 'c', 0)",
+		"INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (2, 10, '', 100, 0), (3, 10, '', 500, 0), (3, 11, '', 0, 0), (1, 13, '', 0, 0), (3, 13, '', 20, 0)",
+		// 古い集計値が残っていても上書きされる
+		"UPDATE users SET reactions = 99, tips = 99, live_comments = 99",
+		"UPDATE livestreams SET reactions = 99, tips = 99, max_tip = 99",
+	)
+
+	wantUsers, wantLivestreams := legacyCounters(t, db)
+
+	if _, err := db.Exec(recomputeUserCountersQuery); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(recomputeLivestreamCountersQuery); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotUsers, gotLivestreams []counterRow
+	if err := db.Select(&gotUsers, "SELECT id, reactions, tips, live_comments FROM users ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Select(&gotLivestreams, "SELECT id, reactions, tips, max_tip FROM livestreams ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotUsers, wantUsers) {
+		t.Errorf("users = %+v, want %+v", gotUsers, wantUsers)
+	}
+	if !reflect.DeepEqual(gotLivestreams, wantLivestreams) {
+		t.Errorf("livestreams = %+v, want %+v", gotLivestreams, wantLivestreams)
+	}
+}
+
+func TestWarmUserCache(t *testing.T) {
+	mock := setupMockDB(t)
+	ctx := context.Background()
+	alice := UserModel{ID: 1, Name: "alice", DisplayName: "Alice", IconHash: []byte("alice-icon")}
+	bob := UserModel{ID: 2, Name: "bob", DisplayName: "Bob", IconHash: []byte("bob-icon")}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users")).
+		WillReturnRows(userRows(alice, bob))
+
+	if err := warmUserCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 以降の参照はDBを引かない (引くとsqlmockがエラーを返す)
+	for _, want := range []UserModel{alice, bob} {
+		got, err := getUserWithCache(ctx, want.ID)
+		if err != nil {
+			t.Fatalf("getUserWithCache(%d): %v", want.ID, err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("getUserWithCache(%d) = %+v, want %+v", want.ID, *got, want)
+		}
+		got, err = getUserByName(ctx, want.Name)
+		if err != nil {
+			t.Fatalf("getUserByName(%s): %v", want.Name, err)
+		}
+		if got.ID != want.ID {
+			t.Errorf("getUserByName(%s).ID = %d, want %d", want.Name, got.ID, want.ID)
+		}
+		if user := getUserOnlyCache(want.ID); user == nil || !bytes.Equal(user.IconHash, want.IconHash) {
+			t.Errorf("icon hash of %s is not cached", want.Name)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	e := echo.New()
+	e.Use(bodyLimitMiddleware("1K"))
+	readBody := func(c echo.Context) error {
+		if _, err := io.ReadAll(c.Request().Body); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusCreated)
+	}
+	e.POST("/api/livestream/:livestream_id/livecomment", readBody)
+	e.POST("/api/icon", readBody, middleware.BodyLimit("4K"))
+
+	cases := []struct {
+		name string
+		path string
+		size int
+		want int
+	}{
+		{"within limit", "/api/livestream/1/livecomment", 512, http.StatusCreated},
+		{"oversized", "/api/livestream/1/livecomment", 2048, http.StatusRequestEntityTooLarge},
+		{"icon above the default limit", "/api/icon", 2048, http.StatusCreated},
+		{"oversized icon", "/api/icon", 8192, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(strings.Repeat("a", tc.size)))
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
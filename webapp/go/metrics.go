@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// /metrics で公開するメトリクス (ISUCON13_DEBUG=1 のときのみ)
+//
+//   - isupipe_http_requests_total{method,route,status}: リクエスト数
+//   - isupipe_http_request_duration_seconds{method,route,status}: レイテンシのヒストグラム
+//   - go_sql_*{db_name="isupipe"}: dbConn.Stats() の値
+//     (open/idle/in_use_connections, wait_count, wait_duration_seconds など)
+//
+// routeにはパスパラメータ展開前のパス (c.Path()) を使うので、カーディナリティは登録ルート数で抑えられる
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "isupipe",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "isupipe",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func newMetricsRegistry(db *sqlx.DB) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		collectors.NewDBStatsCollector(db.DB, "isupipe"),
+	)
+	return reg
+}
+
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				status = he.Code
+			} else {
+				status = http.StatusInternalServerError
+			}
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := prometheus.Labels{
+			"method": c.Request().Method,
+			"route":  route,
+			"status": strconv.Itoa(status),
+		}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+func metricsHandler(reg *prometheus.Registry) echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+}
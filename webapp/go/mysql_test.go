@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 実際のMySQLで挙動を確かめるテスト用
+// ISUCON13_TEST_MYSQL_DSN が設定されていない場合はスキップする
+// テーブルは毎回作り直すので、専用のデータベースを指定すること
+//
+//	ISUCON13_TEST_MYSQL_DSN='isucon:isucon@tcp(127.0.0.1:3306)/isupipe_test' go test ./...
+const testMySQLDSNEnvKey = "ISUCON13_TEST_MYSQL_DSN"
+
+var testSchemaFiles = []string{
+	"../sql/initdb.d/10_schema.sql",
+	"../sql/alter_users.sql",
+}
+
+// initial_users.sql の末尾で追加しているカラム
+var testSchemaExtraStatements = []string{
+	"ALTER TABLE users ADD COLUMN dark_mode BOOLEAN NOT NULL DEFAULT true",
+	"ALTER TABLE users ADD COLUMN icon_hash BINARY(32) NOT NULL DEFAULT X'd9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0'",
+}
+
+// dbConn を空のスキーマを入れたMySQLに差し替える
+func setupTestMySQL(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	dsn, ok := os.LookupEnv(testMySQLDSNEnvKey)
+	if !ok {
+		t.Skipf("%s is not set", testMySQLDSNEnvKey)
+	}
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", testMySQLDSNEnvKey, err)
+	}
+	conf.ParseTime = true
+	conf.InterpolateParams = true
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, path := range testSchemaFiles {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range splitSQLStatements(string(body)) {
+			// スキーマファイルは本番のデータベース名を USE しているので飛ばす
+			if strings.HasPrefix(strings.ToUpper(stmt), "USE ") {
+				continue
+			}
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				t.Fatalf("failed to apply %s: %v\n%s", path, err, stmt)
+			}
+		}
+	}
+	for _, stmt := range testSchemaExtraStatements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("failed to apply schema: %v\n%s", err, stmt)
+		}
+	}
+
+	prev := dbConn
+	dbConn = db
+	resetCachesForTest()
+	t.Cleanup(func() {
+		db.Close()
+		dbConn = prev
+		resetCachesForTest()
+	})
+	return db
+}
+
+// コメント行を除いて ; で区切る
+func splitSQLStatements(body string) []string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	var stmts []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+func execForTest(t *testing.T, db *sqlx.DB, stmts ...string) {
+	t.Helper()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("failed to exec: %v\n%s", err, stmt)
+		}
+	}
+}
@@ -2,33 +2,52 @@ package main
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/hlts2/gocache"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	paymentCacheKey = "payment"
+	paymentCacheTTL = 3 * time.Second
+)
+
+// 投げ銭のあるライブコメントが投稿・削除されたら破棄する
+var paymentCache = gocache.New(gocache.WithExpireAt(paymentCacheTTL))
+
 type PaymentResult struct {
-	TotalTip int64 `json:"total_tip"`
+	TotalTip  int64               `json:"total_tip"`
+	Breakdown []LivestreamPayment `json:"breakdown"`
+}
+
+type LivestreamPayment struct {
+	LivestreamID int64 `json:"livestream_id" db:"livestream_id"`
+	TotalTip     int64 `json:"total_tip" db:"total_tip"`
 }
 
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	if result, found := paymentCache.Get(paymentCacheKey); found {
+		return c.JSON(http.StatusOK, result.(*PaymentResult))
 	}
-	defer tx.Rollback()
 
-	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+	breakdown := []LivestreamPayment{}
+	if err := dbConn.SelectContext(ctx, &breakdown, "SELECT livestream_id, SUM(tip) AS total_tip FROM livecomments WHERE tip > 0 GROUP BY livestream_id ORDER BY total_tip DESC, livestream_id ASC"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	var totalTip int64
+	for _, p := range breakdown {
+		totalTip += p.TotalTip
+	}
+
+	result := &PaymentResult{
+		TotalTip:  totalTip,
+		Breakdown: breakdown,
 	}
+	paymentCache.Set(paymentCacheKey, result)
 
-	return c.JSON(http.StatusOK, &PaymentResult{
-		TotalTip: totalTip,
-	})
+	return c.JSON(http.StatusOK, result)
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ランキングのキャッシュ
+// リアクション・投げ銭で集計値が変わったときは古いものとして印を付け、再構築中は古いものを返す
+// 取りこぼしに備えてTTLでも再構築する
+const (
+	rankingCacheTTL = 5 * time.Second
+	// 再構築はリクエストのcontextと切り離して行うので、別にタイムアウトを設ける
+	rankingRebuildTimeout = 10 * time.Second
+)
+
+type rankingSnapshot struct {
+	builtAt time.Time
+	// 構築を始めた時点の世代
+	gen uint64
+
+	// スコアの昇順
+	users       UserRanking
+	livestreams LivestreamRanking
+	// 1始まりの順位
+	userRanks       map[string]int64
+	livestreamRanks map[int64]int64
+}
+
+var rankingCache struct {
+	mtx      sync.Mutex
+	snapshot *rankingSnapshot
+	// 集計値が変わるたびに進める。snapshot.gen と一致しなければ古い
+	gen uint64
+	// resetRankingCache した時点の世代。これより前に始まった構築結果は捨てる
+	resetGen uint64
+
+	group singleflight.Group
+}
+
+// 集計値が変わったときに呼ぶ。再構築が終わるまでは古いランキングを返す
+func invalidateRankingCache() {
+	rankingCache.mtx.Lock()
+	defer rankingCache.mtx.Unlock()
+	rankingCache.gen++
+}
+
+// initialize などでデータが入れ替わったときに呼ぶ。古いランキングも返さない
+func resetRankingCache() {
+	rankingCache.mtx.Lock()
+	defer rankingCache.mtx.Unlock()
+	rankingCache.gen++
+	rankingCache.resetGen = rankingCache.gen
+	rankingCache.snapshot = nil
+}
+
+// キャッシュが新しければそのまま、古ければ裏で再構築しつつ古いものを返す
+// キャッシュが無いか forceRebuild の場合は再構築を待つ
+func getRankingSnapshot(ctx context.Context, forceRebuild bool) (*rankingSnapshot, error) {
+	rankingCache.mtx.Lock()
+	s := rankingCache.snapshot
+	fresh := s != nil && s.gen == rankingCache.gen && time.Since(s.builtAt) < rankingCacheTTL
+	rankingCache.mtx.Unlock()
+
+	if s != nil && !forceRebuild {
+		if !fresh {
+			rankingCache.group.DoChan("ranking", rebuildRankingSnapshot)
+		}
+		return s, nil
+	}
+
+	select {
+	case res := <-rankingCache.group.DoChan("ranking", rebuildRankingSnapshot):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*rankingSnapshot), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 待っているリクエストがキャンセルされても構築は続けて、他のリクエストに結果を渡す
+func rebuildRankingSnapshot() (interface{}, error) {
+	rankingCache.mtx.Lock()
+	gen := rankingCache.gen
+	rankingCache.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rankingRebuildTimeout)
+	defer cancel()
+	s, err := buildRankingSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.gen = gen
+
+	rankingCache.mtx.Lock()
+	defer rankingCache.mtx.Unlock()
+	if gen >= rankingCache.resetGen {
+		rankingCache.snapshot = s
+	}
+	return s, nil
+}
+
+func buildRankingSnapshot(ctx context.Context) (*rankingSnapshot, error) {
+	var users []*UserModel
+	if err := dbConn.SelectContext(ctx, &users, "SELECT `name`, `reactions`, `tips` FROM users"); err != nil {
+		return nil, err
+	}
+	var livestreams []*LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreams, "SELECT `id`, `reactions`, `tips` FROM livestreams"); err != nil {
+		return nil, err
+	}
+
+	s := &rankingSnapshot{
+		builtAt:         time.Now(),
+		users:           make(UserRanking, 0, len(users)),
+		livestreams:     make(LivestreamRanking, 0, len(livestreams)),
+		userRanks:       make(map[string]int64, len(users)),
+		livestreamRanks: make(map[int64]int64, len(livestreams)),
+	}
+	for _, user := range users {
+		s.users = append(s.users, UserRankingEntry{
+			Username: user.Name,
+			Score:    user.Reactions + user.Tips,
+		})
+	}
+	sort.Sort(s.users)
+	for i, entry := range s.users {
+		s.userRanks[entry.Username] = int64(len(s.users) - i)
+	}
+
+	for _, livestream := range livestreams {
+		s.livestreams = append(s.livestreams, LivestreamRankingEntry{
+			LivestreamID: livestream.ID,
+			Score:        livestream.Reactions + livestream.Tips,
+		})
+	}
+	sort.Sort(s.livestreams)
+	for i, entry := range s.livestreams {
+		s.livestreamRanks[entry.LivestreamID] = int64(len(s.livestreams) - i)
+	}
+
+	return s, nil
+}
+
+// キャッシュ構築後に作成されたユーザはキャッシュにいないので、その場合は再構築する
+func getUserRank(ctx context.Context, username string) (int64, error) {
+	s, err := getRankingSnapshot(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	if rank, ok := s.userRanks[username]; ok {
+		return rank, nil
+	}
+	if s, err = getRankingSnapshot(ctx, true); err != nil {
+		return 0, err
+	}
+	return s.userRanks[username], nil
+}
+
+func getLivestreamRank(ctx context.Context, livestreamID int64) (int64, error) {
+	s, err := getRankingSnapshot(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	if rank, ok := s.livestreamRanks[livestreamID]; ok {
+		return rank, nil
+	}
+	if s, err = getRankingSnapshot(ctx, true); err != nil {
+		return 0, err
+	}
+	return s.livestreamRanks[livestreamID], nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectRankingQueries(mock sqlmock.Sqlmock, scores map[string]int64, delay time.Duration) {
+	users := sqlmock.NewRows([]string{"name", "reactions", "tips"})
+	for name, score := range scores {
+		users.AddRow(name, score, 0)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `name`, `reactions`, `tips` FROM users")).
+		WillDelayFor(delay).
+		WillReturnRows(users)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id`, `reactions`, `tips` FROM livestreams")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "reactions", "tips"}).AddRow(1, 0, 0))
+}
+
+// 裏での再構築が終わって、最新の世代のスナップショットが入るまで待つ
+func waitRankingRebuilt(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		rankingCache.mtx.Lock()
+		s, gen := rankingCache.snapshot, rankingCache.gen
+		rankingCache.mtx.Unlock()
+		if s != nil && s.gen == gen {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("ranking snapshot was not rebuilt")
+}
+
+func TestRankingCacheServesSnapshotWithinTTL(t *testing.T) {
+	mock := setupMockDB(t)
+	ctx := context.Background()
+	expectRankingQueries(mock, map[string]int64{"alice": 1, "bob": 2}, 0)
+
+	for i := 0; i < 3; i++ {
+		rank, err := getUserRank(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rank != 2 {
+			t.Errorf("rank of alice = %d, want 2", rank)
+		}
+	}
+}
+
+func TestRankingCacheServesStaleSnapshotAfterReaction(t *testing.T) {
+	mock := setupMockDB(t)
+	ctx := context.Background()
+	expectRankingQueries(mock, map[string]int64{"alice": 1, "bob": 2}, 0)
+	if rank, err := getUserRank(ctx, "alice"); err != nil || rank != 2 {
+		t.Fatalf("getUserRank = %d, %v, want 2", rank, err)
+	}
+
+	// リアクションで alice のスコアが bob を抜いた
+	expectRankingQueries(mock, map[string]int64{"alice": 3, "bob": 2}, 50*time.Millisecond)
+	invalidateRankingCache()
+
+	// 再構築中は古い順位を待たずに返す
+	start := time.Now()
+	rank, err := getUserRank(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rank != 2 {
+		t.Errorf("rank of alice while rebuilding = %d, want stale 2", rank)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("stale read waited for rebuild: %s", elapsed)
+	}
+
+	waitRankingRebuilt(t)
+	if rank, err := getUserRank(ctx, "alice"); err != nil || rank != 1 {
+		t.Errorf("rank of alice after rebuild = %d, %v, want 1", rank, err)
+	}
+}
+
+func TestRankingCacheResetDropsSnapshot(t *testing.T) {
+	mock := setupMockDB(t)
+	ctx := context.Background()
+	expectRankingQueries(mock, map[string]int64{"alice": 1, "bob": 2}, 0)
+	if _, err := getUserRank(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// initialize後は古い順位を返さずに再構築を待つ
+	expectRankingQueries(mock, map[string]int64{"alice": 3, "bob": 2}, 0)
+	resetRankingCache()
+	if rank, err := getUserRank(ctx, "alice"); err != nil || rank != 1 {
+		t.Errorf("rank of alice after reset = %d, %v, want 1", rank, err)
+	}
+}
+
+func TestRankingCacheRebuildSurvivesCanceledRequest(t *testing.T) {
+	mock := setupMockDB(t)
+	// 再構築は1回だけ
+	expectRankingQueries(mock, map[string]int64{"alice": 1}, 100*time.Millisecond)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var canceledErr, err error
+	var rank int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, canceledErr = getUserRank(canceled, "alice")
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		rank, err = getUserRank(context.Background(), "alice")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	if !errors.Is(canceledErr, context.Canceled) {
+		t.Errorf("canceled request error = %v, want context.Canceled", canceledErr)
+	}
+	if err != nil || rank != 1 {
+		t.Errorf("other request got %d, %v, want 1", rank, err)
+	}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -32,6 +33,19 @@ type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
 }
 
+const (
+	// 一括投稿できるリアクションの最大件数
+	maxBulkReactions = 100
+	// reactions.emoji_name の長さの上限
+	maxEmojiNameLen = 255
+)
+
+type PostBulkReactionRequest struct {
+	EmojiName string `json:"emoji_name"`
+	// 省略した場合はサーバの現在時刻
+	CreatedAt int64 `json:"created_at"`
+}
+
 // Live Streamのリアクションを指定した件数取得する
 func getReactionsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
@@ -52,7 +66,28 @@ func getReactionsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
+	livestreamModels, err := getLivestreamsByIDs(ctx, tx, []int64{int64(livestreamID)})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	livestreamModel, ok := livestreamModels[int64(livestreamID)]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	// created_at はクライアント指定の値が入り得るため、ページングと揃えて常に id 順で返す
+	query := "SELECT * FROM reactions WHERE livestream_id = ?"
+	params := []interface{}{livestreamID}
+	if c.QueryParam("before_id") != "" {
+		// 過去のリアクションを遡るためのページング
+		beforeID, err := strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+		query += " AND id < ?"
+		params = append(params, beforeID)
+	}
+	query += " ORDER BY id DESC"
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
@@ -62,7 +97,7 @@ func getReactionsHandler(c echo.Context) error {
 	}
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reactionModels, query, params...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
 	userIds := make([]int64, len(reactionModels))
@@ -73,13 +108,8 @@ func getReactionsHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("invalid user: %w", err)
 	}
-	livestreamModel := LivestreamModel{}
-	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
-	}
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
 	livestreamUser, err := getUserWithCache(ctx, livestreamModel.UserID)
@@ -87,9 +117,15 @@ func getReactionsHandler(c echo.Context) error {
 		return fmt.Errorf("invalid user: %w", err)
 	}
 
+	// 全リアクションで同じ配信なので、レスポンスは1回だけ組み立てる
+	livestream, err := fillLivestreamResponse(ctx, livestreamModel, livestreamUser, tagsId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
 	reactions := make([]Reaction, len(reactionModels))
 	for i := range reactionModels {
-		reaction, err := fillReactionResponse(ctx, reactionModels[i], reactionUsers[reactionModels[i].UserID], &livestreamModel, tagsId, livestreamUser)
+		reaction, err := fillReactionResponse(ctx, reactionModels[i], reactionUsers[reactionModels[i].UserID], livestream)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 		}
@@ -104,6 +140,73 @@ func getReactionsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, reactions)
 }
 
+// リアクションを1件取得する (投稿時のLocationが指す先)
+// GET /api/livestream/:livestream_id/reaction/:reaction_id
+func getReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	reactionID, err := strconv.Atoi(c.Param("reaction_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "reaction_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var reactionModel ReactionModel
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ? AND livestream_id = ?", reactionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "reaction not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+	}
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	livestreamUser, err := getUserWithCache(ctx, livestreamModel.UserID)
+	if err != nil {
+		return fmt.Errorf("invalid user: %w", err)
+	}
+	reactionUser, err := getUserWithCache(ctx, reactionModel.UserID)
+	if err != nil {
+		return fmt.Errorf("invalid user: %w", err)
+	}
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get tags id: %w", err)
+	}
+	livestream, err := fillLivestreamResponse(ctx, &livestreamModel, livestreamUser, tagsId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+	reaction, err := fillReactionResponse(ctx, reactionModel, reactionUser, livestream)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, reaction)
+}
+
 func postReactionHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
@@ -111,19 +214,17 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
 	var req *PostReactionRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -141,9 +242,20 @@ func postReactionHandler(c echo.Context) error {
 
 	livestreamModel := LivestreamModel{}
 	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
+	// 配信中でないライブ配信にはリアクションできない
+	if enforceReactionWindow && (reactionModel.CreatedAt < livestreamModel.StartAt || reactionModel.CreatedAt > livestreamModel.EndAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't react to a livestream that is not live")
+	}
+	livestreamUser, err := getLivestreamOwner(ctx, &livestreamModel)
+	if err != nil {
+		return err
+	}
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
@@ -171,15 +283,15 @@ func postReactionHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("invalid user: %w", err)
 	}
-	var tagsId []int64
-	if err := tx.SelectContext(ctx, &tagsId, "SELECT `tag_id` FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
 		return fmt.Errorf("failed to get tags id: %w", err)
 	}
-	livestreamUser, err := getUserWithCache(ctx, livestreamModel.UserID)
+	livestream, err := fillLivestreamResponse(ctx, &livestreamModel, livestreamUser, tagsId)
 	if err != nil {
-		return fmt.Errorf("invalid user: %w", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
-	reaction, err := fillReactionResponse(ctx, reactionModel, reactionUser, &livestreamModel, tagsId, livestreamUser)
+	reaction, err := fillReactionResponse(ctx, reactionModel, reactionUser, livestream)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
@@ -187,16 +299,394 @@ func postReactionHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	invalidateRankingCache()
 
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/livestream/%d/reaction/%d", livestreamID, reactionID))
 	return c.JSON(http.StatusCreated, reaction)
 }
 
-func fillReactionResponse(ctx context.Context, reactionModel ReactionModel, reactionUserModel *UserModel, livestreamModel *LivestreamModel, tagIds []int64, liveOwnerModel *UserModel) (Reaction, error) {
-	user, err := fillUserResponse(ctx, reactionUserModel)
+// リアクション先のライブ配信の配信者を取得する
+// 配信者のユーザが存在しない場合は、集計値やお気に入り絵文字を更新できないので404を返す
+func getLivestreamOwner(ctx context.Context, livestreamModel *LivestreamModel) (*UserModel, error) {
+	owner, err := getUserWithCache(ctx, livestreamModel.UserID)
 	if err != nil {
-		return Reaction{}, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "not found the owner of the livestream")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream owner: "+err.Error())
+	}
+	return owner, nil
+}
+
+// オフラインで溜めたリアクションをまとめて投稿する
+// 全件を1回のINSERTで追加し、集計値もまとめて更新する
+// POST /api/livestream/:livestream_id/reactions
+func postBulkReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var reqs []PostBulkReactionRequest
+	if err := decodeRequestBody(c, &reqs); err != nil {
+		return err
+	}
+	if len(reqs) == 0 || len(reqs) > maxBulkReactions {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the number of reactions must be between 1 and %d", maxBulkReactions))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel := LivestreamModel{}
+	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
 	}
-	livestream, err := fillLivestreamResponse(ctx, livestreamModel, liveOwnerModel, tagIds)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	reactionModels := make([]ReactionModel, len(reqs))
+	var fieldErrors []FieldError
+	for i, req := range reqs {
+		if req.CreatedAt == 0 {
+			req.CreatedAt = now
+		}
+		if req.EmojiName == "" || utf8.RuneCountInString(req.EmojiName) > maxEmojiNameLen {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("[%d].emoji_name", i), Message: fmt.Sprintf("must be 1 to %d characters", maxEmojiNameLen)})
+		}
+		if req.CreatedAt < 0 || req.CreatedAt > now {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("[%d].created_at", i), Message: "must not be in the future"})
+		} else if enforceReactionWindow && (req.CreatedAt < livestreamModel.StartAt || req.CreatedAt > livestreamModel.EndAt) {
+			// 配信中でないライブ配信にはリアクションできない
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("[%d].created_at", i), Message: "must be within the livestream"})
+		}
+		reactionModels[i] = ReactionModel{
+			UserID:       userID,
+			LivestreamID: int64(livestreamID),
+			EmojiName:    req.EmojiName,
+			CreatedAt:    req.CreatedAt,
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return newValidationError("invalid reactions", fieldErrors)
+	}
+	livestreamUser, err := getLivestreamOwner(ctx, &livestreamModel)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reactions: "+err.Error())
+	}
+	// 複数行のINSERTでは先頭行のIDが返り、以降の行には連続したIDが振られる
+	firstID, err := result.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+	}
+	for i := range reactionModels {
+		reactionModels[i].ID = firstID + int64(i)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET reactions = reactions + ? WHERE id = ?", len(reactionModels), livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream reaction counter: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET reactions = reactions + ? WHERE id = ?", len(reactionModels), livestreamModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reactions: "+err.Error())
+	}
+	favoriteEmojis := make([]map[string]interface{}, len(reactionModels))
+	for i, reactionModel := range reactionModels {
+		favoriteEmojis[i] = map[string]interface{}{"user_id": livestreamModel.UserID, "emoji_name": reactionModel.EmojiName}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO favorite_emojis (user_id, emoji_name) VALUES (:user_id, :emoji_name)", favoriteEmojis); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to add favorite_emojis: "+err.Error())
+	}
+
+	reactionUser, err := getUserWithCache(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	tagsId, err := getLivestreamTagIDs(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	livestream, err := fillLivestreamResponse(ctx, &livestreamModel, livestreamUser, tagsId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+	reactions := make([]Reaction, len(reactionModels))
+	for i, reactionModel := range reactionModels {
+		reaction, err := fillReactionResponse(ctx, reactionModel, reactionUser, livestream)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		}
+		reactions[i] = reaction
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	invalidateRankingCache()
+
+	return c.JSON(http.StatusCreated, reactions)
+}
+
+// 自分のリアクションを取り消す
+// DELETE /api/livestream/:livestream_id/reaction/:reaction_id
+func deleteReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	reactionID, err := strconv.Atoi(c.Param("reaction_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "reaction_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var reactionModel ReactionModel
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ? AND livestream_id = ? FOR UPDATE", reactionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "reaction not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+	}
+	if reactionModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other user's reaction")
+	}
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE id = ?", reactionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reaction: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET reactions = IF(reactions > 0, reactions - 1, 0) WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream reaction counter: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET reactions = IF(reactions > 0, reactions - 1, 0) WHERE id = ?", livestreamModel.UserID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reactions: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM favorite_emojis WHERE user_id = ? AND emoji_name = ? LIMIT 1", livestreamModel.UserID, reactionModel.EmojiName); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete favorite_emojis: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	invalidateRankingCache()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+const (
+	defaultReactionTimelineBucket = 60
+	maxReactionTimelineBuckets    = 1000
+)
+
+type ReactionTimeline struct {
+	Bucket  int64                    `json:"bucket"`
+	Buckets []ReactionTimelineBucket `json:"buckets"`
+}
+
+type ReactionTimelineBucket struct {
+	StartAt int64 `json:"start_at"`
+	Count   int64 `json:"count"`
+}
+
+// 配信期間中のリアクション数をbucket秒ごとに集計する (配信者のみ)
+// GET /api/livestream/:livestream_id/reaction/timeline
+func getReactionTimelineHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var bucket int64 = defaultReactionTimelineBucket
+	if c.QueryParam("bucket") != "" {
+		b, err := strconv.ParseInt(c.QueryParam("bucket"), 10, 64)
+		if err != nil || b < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter must be positive integer")
+		}
+		bucket = b
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's reaction timeline")
+	}
+
+	firstBucket := livestreamModel.StartAt / bucket
+	lastBucket := livestreamModel.EndAt / bucket
+	if lastBucket < firstBucket {
+		lastBucket = firstBucket
+	}
+	if lastBucket-firstBucket+1 > maxReactionTimelineBuckets {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bucket is too small: the timeline must have at most %d buckets", maxReactionTimelineBuckets))
+	}
+
+	var counts []struct {
+		Bucket int64 `db:"bucket"`
+		Count  int64 `db:"count"`
+	}
+	if err := dbConn.SelectContext(ctx, &counts, "SELECT FLOOR(created_at / ?) AS bucket, COUNT(*) AS count FROM reactions WHERE livestream_id = ? AND created_at BETWEEN ? AND ? GROUP BY bucket", bucket, livestreamID, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	// リアクションのない区間も0件として返す
+	timeline := ReactionTimeline{
+		Bucket:  bucket,
+		Buckets: make([]ReactionTimelineBucket, lastBucket-firstBucket+1),
+	}
+	for i := range timeline.Buckets {
+		timeline.Buckets[i].StartAt = (firstBucket + int64(i)) * bucket
+	}
+	for _, count := range counts {
+		timeline.Buckets[count.Bucket-firstBucket].Count = count.Count
+	}
+
+	return c.JSON(http.StatusOK, timeline)
+}
+
+type ReactionSummary struct {
+	Total  int64                  `json:"total"`
+	Emojis []ReactionSummaryEmoji `json:"emojis"`
+	// 上位K件に入らなかった絵文字の合計
+	Other ReactionSummaryOther `json:"other"`
+}
+
+type ReactionSummaryEmoji struct {
+	EmojiName string `json:"emoji_name" db:"emoji_name"`
+	Count     int64  `json:"count" db:"count"`
+}
+
+type ReactionSummaryOther struct {
+	EmojiCount int64 `json:"emoji_count"`
+	Count      int64 `json:"count"`
+}
+
+// ライブ配信のリアクションを絵文字ごとに集計する
+// 件数の多い上位K件 (ISUCON13_REACTION_SUMMARY_TOP_K) のみ個別に返し、残りは other にまとめる
+// 絵文字の種類がK件以下の場合は全て emojis に含まれ、other は0件になる
+// GET /api/livestream/:livestream_id/reaction/summary
+func getReactionSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	var counts []ReactionSummaryEmoji
+	if err := dbConn.SelectContext(ctx, &counts, "SELECT emoji_name, COUNT(*) AS count FROM reactions WHERE livestream_id = ? GROUP BY emoji_name ORDER BY count DESC, emoji_name ASC", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	summary := ReactionSummary{Emojis: []ReactionSummaryEmoji{}}
+	for i, count := range counts {
+		summary.Total += count.Count
+		if i < reactionSummaryTopK {
+			summary.Emojis = append(summary.Emojis, count)
+			continue
+		}
+		summary.Other.EmojiCount++
+		summary.Other.Count += count.Count
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
+
+type ReactionCount struct {
+	Count int64 `json:"count"`
+}
+
+// リアクション数のみを返す軽量なAPI
+// livestreams.reactions に非正規化した件数を1行読むだけで返す
+// GET /api/livestream/:livestream_id/reaction/count
+func getReactionCountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var count ReactionCount
+	if err := dbConn.GetContext(ctx, &count.Count, "SELECT reactions FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, count)
+}
+
+func fillReactionResponse(ctx context.Context, reactionModel ReactionModel, reactionUserModel *UserModel, livestream Livestream) (Reaction, error) {
+	user, err := fillUserResponse(ctx, reactionUserModel)
 	if err != nil {
 		return Reaction{}, err
 	}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+)
+
+func setEnforceReactionWindow(t *testing.T, v bool) {
+	prev := enforceReactionWindow
+	enforceReactionWindow = v
+	t.Cleanup(func() { enforceReactionWindow = prev })
+}
+
+// リアクション投稿が成功したときのクエリ
+func expectReactionInserted(mock sqlmock.Sqlmock, livestreamID, ownerID int64) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO reactions")).
+		WillReturnResult(sqlmock.NewResult(100, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE livestreams SET reactions = reactions + 1 WHERE id = ?")).
+		WithArgs(livestreamID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET reactions = reactions + 1 WHERE id = ?")).
+		WithArgs(ownerID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO favorite_emojis")).
+		WithArgs(ownerID, "innocent").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestPostReactionWindow(t *testing.T) {
+	now := time.Now().Unix()
+	hour := int64(time.Hour / time.Second)
+	cases := []struct {
+		name    string
+		enforce bool
+		startAt int64
+		endAt   int64
+		want    int
+	}{
+		{"live", true, now - hour, now + hour, http.StatusCreated},
+		{"before start", true, now + hour, now + 2*hour, http.StatusBadRequest},
+		{"after end", true, now - 2*hour, now - hour, http.StatusBadRequest},
+		{"after end but disabled", false, now - 2*hour, now - hour, http.StatusCreated},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			setEnforceReactionWindow(t, tc.enforce)
+			cacheUserForTest(&UserModel{ID: 1, Name: "streamer"})
+			cacheUserForTest(&UserModel{ID: 2, Name: "viewer"})
+			livestreamTagsCache.Set(livestreamTagsCacheKey(10), []int64{})
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+				WithArgs(10).
+				WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1, StartAt: tc.startAt, EndAt: tc.endAt}))
+			if tc.want == http.StatusCreated {
+				expectReactionInserted(mock, 10, 1)
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			c, rec := newTestContext(http.MethodPost, "/api/livestream/10/reaction", strings.NewReader(`{"emoji_name":"innocent"}`))
+			withLoginSession(c, 2, "viewer")
+			withParams(c, "livestream_id", "10")
+			if got := statusOf(postReactionHandler(c), rec); got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// 配信者のユーザ行が消えているライブ配信へのリアクションは、集計値を更新せずに404を返す
+func TestPostReactionOwnerMissing(t *testing.T) {
+	cases := []struct {
+		name    string
+		path    string
+		body    string
+		handler func(c echo.Context) error
+	}{
+		{"single", "/api/livestream/10/reaction", `{"emoji_name":"innocent"}`, postReactionHandler},
+		{"bulk", "/api/livestream/10/reactions", `[{"emoji_name":"innocent"},{"emoji_name":"smile"}]`, postBulkReactionsHandler},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			setEnforceReactionWindow(t, false)
+			cacheUserForTest(&UserModel{ID: 2, Name: "viewer"})
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+				WithArgs(10).
+				WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+			mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).
+				WithArgs(1).
+				WillReturnRows(userRows())
+			mock.ExpectRollback()
+
+			c, rec := newTestContext(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			withLoginSession(c, 2, "viewer")
+			withParams(c, "livestream_id", "10")
+			if got := statusOf(tc.handler(c), rec); got != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestPostReactionLocation(t *testing.T) {
+	mock := setupMockDB(t)
+	setEnforceReactionWindow(t, false)
+	cacheUserForTest(&UserModel{ID: 1, Name: "streamer"})
+	cacheUserForTest(&UserModel{ID: 2, Name: "viewer"})
+	livestreamTagsCache.Set(livestreamTagsCacheKey(10), []int64{})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(10).
+		WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+	expectReactionInserted(mock, 10, 1)
+	mock.ExpectCommit()
+
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/10/reaction", strings.NewReader(`{"emoji_name":"innocent"}`))
+	withLoginSession(c, 2, "viewer")
+	withParams(c, "livestream_id", "10")
+	if got := statusOf(postReactionHandler(c), rec); got != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", got, http.StatusCreated)
+	}
+	if got, want := rec.Header().Get(echo.HeaderLocation), "/api/livestream/10/reaction/100"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
+
+func TestGetReaction(t *testing.T) {
+	reactionColumns := []string{"id", "emoji_name", "user_id", "livestream_id", "created_at"}
+	cases := []struct {
+		name         string
+		livestreamID int
+		rows         *sqlmock.Rows
+		want         int
+	}{
+		{"found", 10, sqlmock.NewRows(reactionColumns).AddRow(100, "innocent", 2, 10, 0), http.StatusOK},
+		// 別のライブ配信のリアクションとしては取得できない
+		{"other livestream", 11, sqlmock.NewRows(reactionColumns), http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			cacheUserForTest(&UserModel{ID: 1, Name: "streamer"})
+			cacheUserForTest(&UserModel{ID: 2, Name: "viewer"})
+			livestreamTagsCache.Set(livestreamTagsCacheKey(10), []int64{})
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM reactions WHERE id = ? AND livestream_id = ?")).
+				WithArgs(100, tc.livestreamID).
+				WillReturnRows(tc.rows)
+			if tc.want == http.StatusOK {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+					WithArgs(10).
+					WillReturnRows(livestreamRows(LivestreamModel{ID: 10, UserID: 1}))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			c, rec := newTestContext(http.MethodGet, fmt.Sprintf("/api/livestream/%d/reaction/100", tc.livestreamID), nil)
+			withLoginSession(c, 2, "viewer")
+			withParams(c, "livestream_id", strconv.Itoa(tc.livestreamID), "reaction_id", "100")
+			if got := statusOf(getReactionHandler(c), rec); got != tc.want {
+				t.Fatalf("status = %d, want %d", got, tc.want)
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			var reaction Reaction
+			if err := json.Unmarshal(rec.Body.Bytes(), &reaction); err != nil {
+				t.Fatal(err)
+			}
+			if reaction.ID != 100 || reaction.EmojiName != "innocent" || reaction.User.ID != 2 {
+				t.Errorf("reaction = %+v", reaction)
+			}
+		})
+	}
+}
+
+// 100件のリアクションのレスポンスを組み立てるときの、配信のレスポンスを共有する効果を測る
+//
+//	go test -run '^$' -bench BenchmarkReactionResponses -benchmem
+func BenchmarkReactionResponses(b *testing.B) {
+	ctx := context.Background()
+	owner := &UserModel{ID: 1, Name: "streamer", IconHash: make([]byte, 32)}
+	livestreamModel := &LivestreamModel{ID: 10, UserID: owner.ID, Title: "title"}
+	tagIDs := []int64{1, 2, 3}
+	users := make(map[int64]*UserModel)
+	reactionModels := make([]ReactionModel, 100)
+	for i := range reactionModels {
+		userID := int64(100 + i%10)
+		users[userID] = &UserModel{ID: userID, Name: fmt.Sprintf("viewer%d", userID), IconHash: make([]byte, 32)}
+		reactionModels[i] = ReactionModel{ID: int64(i + 1), EmojiName: "innocent", UserID: userID, LivestreamID: livestreamModel.ID}
+	}
+
+	b.Run("per reaction", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			reactions := make([]Reaction, len(reactionModels))
+			for i := range reactionModels {
+				livestream, err := fillLivestreamResponse(ctx, livestreamModel, owner, tagIDs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if reactions[i], err = fillReactionResponse(ctx, reactionModels[i], users[reactionModels[i].UserID], livestream); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			livestream, err := fillLivestreamResponse(ctx, livestreamModel, owner, tagIDs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reactions := make([]Reaction, len(reactionModels))
+			for i := range reactionModels {
+				if reactions[i], err = fillReactionResponse(ctx, reactionModels[i], users[reactionModels[i].UserID], livestream); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// 存在しないライブ配信へのリアクションは、INSERTせずに404を返す
+func TestReactionsLivestreamNotFound(t *testing.T) {
+	cases := []struct {
+		name    string
+		method  string
+		body    string
+		query   string
+		handler func(c echo.Context) error
+	}{
+		{"post", http.MethodPost, `{"emoji_name":"innocent"}`, "SELECT * FROM livestreams WHERE id = ?", postReactionHandler},
+		{"get", http.MethodGet, "", "SELECT * FROM livestreams WHERE id IN (?)", getReactionsHandler},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			cacheUserForTest(&UserModel{ID: 2, Name: "viewer"})
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta(tc.query)).
+				WithArgs(999).
+				WillReturnRows(livestreamRows())
+			mock.ExpectRollback()
+
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			c, rec := newTestContext(tc.method, "/api/livestream/999/reaction", body)
+			withLoginSession(c, 2, "viewer")
+			withParams(c, "livestream_id", "999")
+			if got := statusOf(tc.handler(c), rec); got != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func TestGetReactionsPagingOrder(t *testing.T) {
+	db := setupTestMySQL(t)
+	// 一括投稿では created_at をクライアントが指定できるため、id 順と食い違う
+	execForTest(t, db,
+		"INSERT INTO users (id, name, display_name, password, description) VALUES (1, 'streamer', '', '', ''), (2, 'viewer', '', '', '')",
+		"INSERT INTO livestreams (id, user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (10, 1, '', '', '', '', 0, 0)",
+		"INSERT INTO reactions (id, user_id, livestream_id, emoji_name, created_at) VALUES (1, 2, 10, 'a', 300), (2, 2, 10, 'b', 100), (3, 2, 10, 'c', 200)",
+	)
+
+	var got []int64
+	query := "limit=2"
+	for i := 0; i < 3; i++ {
+		c, rec := newTestContext(http.MethodGet, "/api/livestream/10/reaction?"+query, nil)
+		withLoginSession(c, 2, "viewer")
+		withParams(c, "livestream_id", "10")
+		if status := statusOf(getReactionsHandler(c), rec); status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+		var page []Reaction
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, r := range page {
+			got = append(got, r.ID)
+		}
+		query = fmt.Sprintf("limit=2&before_id=%d", page[len(page)-1].ID)
+	}
+	if !reflect.DeepEqual(got, []int64{3, 2, 1}) {
+		t.Errorf("reaction ids = %v, want [3 2 1]", got)
+	}
+}
+
+func TestPostBulkReactionsInvalidFields(t *testing.T) {
+	mock := setupMockDB(t)
+	setEnforceReactionWindow(t, false)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(livestreamRows(LivestreamModel{ID: 1, UserID: 10}))
+	mock.ExpectRollback()
+
+	future := time.Now().Add(time.Hour).Unix()
+	body := fmt.Sprintf(`[{"emoji_name":"innocent"},{"emoji_name":""},{"emoji_name":"innocent","created_at":%d}]`, future)
+	c, rec := newTestContext(http.MethodPost, "/api/livestream/1/reactions", strings.NewReader(body))
+	withLoginSession(c, 2, "viewer")
+	withParams(c, "livestream_id", "1")
+	errorResponseHandler(postBulkReactionsHandler(c), c)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != errCodeValidationFailed {
+		t.Errorf("code = %s, want %s", res.Code, errCodeValidationFailed)
+	}
+	var fields []string
+	for _, fe := range res.Fields {
+		fields = append(fields, fe.Field)
+	}
+	if want := []string{"[1].emoji_name", "[2].created_at"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("invalid fields = %v, want %v", fields, want)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
+	"time"
 
+	"github.com/hlts2/gocache"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
@@ -17,6 +20,40 @@ type LivestreamStatistics struct {
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	ViewerCounts
+}
+
+// 視聴者数の内訳
+type ViewerCounts struct {
+	// 直近のハートビートがある現在の視聴者数
+	LiveViewersCount int64 `json:"live_viewers_count" db:"live_viewers_count"`
+	// 退室済みも含めた、これまでに入室したユーザ数
+	TotalViewersCount int64 `json:"total_viewers_count" db:"total_viewers_count"`
+}
+
+const viewerCountsColumns = "COUNT(*) AS total_viewers_count, COALESCE(SUM(h.ended_at IS NULL AND h.updated_at >= ?), 0) AS live_viewers_count"
+
+// 配信者ごとに、その配信の視聴者数の内訳を集計する
+func getViewerCountsByOwner(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]ViewerCounts, error) {
+	ret := make(map[int64]ViewerCounts, len(userIDs))
+	if len(userIDs) == 0 {
+		return ret, nil
+	}
+	query, params, err := sqlx.In("SELECT l.user_id, "+viewerCountsColumns+" FROM livestream_viewers_history h INNER JOIN livestreams l ON l.id = h.livestream_id WHERE l.user_id IN (?) GROUP BY l.user_id", liveViewerThreshold(), userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		UserID int64 `db:"user_id"`
+		ViewerCounts
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, query, params...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ret[row.UserID] = row.ViewerCounts
+	}
+	return ret, nil
 }
 
 type LivestreamRankingEntry struct {
@@ -36,12 +73,46 @@ func (r LivestreamRanking) Less(i, j int) bool {
 }
 
 type UserStatistics struct {
-	Rank              int64  `json:"rank"`
-	ViewersCount      int64  `json:"viewers_count"`
+	Rank         int64 `json:"rank"`
+	ViewersCount int64 `json:"viewers_count"`
+	// ユーザの配信が受け取ったリアクション数
 	TotalReactions    int64  `json:"total_reactions"`
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	// ユーザが視聴者として他の配信に送ったリアクション数
+	ReactionsGiven int64 `json:"reactions_given"`
+	// ユーザが視聴者として配信を視聴した累計秒数
+	TotalWatchSeconds int64 `json:"total_watch_seconds"`
+	ViewerCounts
+}
+
+// 視聴者ごとの累計視聴秒数
+// 退室していない視聴は、現在時刻か配信終了時刻の早い方までを視聴したものとして数える
+const watchSecondsQuery = `SELECT h.user_id, COALESCE(SUM(h.watch_seconds + IF(h.ended_at IS NULL, GREATEST(LEAST(?, l.end_at) - h.created_at, 0), 0)), 0) AS watch_seconds
+	FROM livestream_viewers_history h INNER JOIN livestreams l ON l.id = h.livestream_id
+	WHERE h.user_id IN (?) GROUP BY h.user_id`
+
+func getTotalWatchSeconds(ctx context.Context, q sqlx.QueryerContext, userIDs []int64) (map[int64]int64, error) {
+	ret := make(map[int64]int64, len(userIDs))
+	if len(userIDs) == 0 {
+		return ret, nil
+	}
+	query, params, err := sqlx.In(watchSecondsQuery, time.Now().Unix(), userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		UserID       int64 `db:"user_id"`
+		WatchSeconds int64 `db:"watch_seconds"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, query, params...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ret[row.UserID] = row.WatchSeconds
+	}
+	return ret, nil
 }
 
 type UserRankingEntry struct {
@@ -81,37 +152,16 @@ func getUserStatisticsHandler(c echo.Context) error {
 	var user UserModel
 	if err := tx.GetContext(ctx, &user, "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`reactions`,`tips`,`live_comments` FROM users WHERE name = ?", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 		}
 	}
 
 	// ランク算出
-	var users []*UserModel
-	if err := tx.SelectContext(ctx, &users, "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`reactions`,`tips`,`live_comments` FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
-	}
-
-	var ranking UserRanking
-
-	for _, user := range users {
-		score := user.Reactions + user.Tips
-		ranking = append(ranking, UserRankingEntry{
-			Username: user.Name,
-			Score:    score,
-		})
-	}
-
-	sort.Sort(ranking)
-
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.Username == username {
-			break
-		}
-		rank++
+	rank, err := getUserRank(ctx, username)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
 	}
 
 	var livestreamsIDs []int64
@@ -119,10 +169,10 @@ func getUserStatisticsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
-	// 合計視聴者数
+	// 合計視聴者数 (livestream_viewers_history はユーザとライブ配信の組で一意、退室済みのものは除く)
 	var viewersCount int64
 
-	query, params, err := sqlx.In("SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id IN (?)", livestreamsIDs)
+	query, params, err := sqlx.In("SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id IN (?) AND ended_at IS NULL", livestreamsIDs)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
 	}
@@ -133,10 +183,31 @@ func getUserStatisticsHandler(c echo.Context) error {
 
 	// お気に入り絵文字
 	var favoriteEmoji string
-
-	if err := tx.GetContext(ctx, &favoriteEmoji, "SELECT emoji_name FROM favorite_emojis WHERE user_id = ? GROUP BY emoji_name ORDER BY COUNT(*) DESC, emoji_name DESC LIMIT 1", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	favoriteEmojis, err := getFavoriteEmojis(ctx, tx, user.ID, 1)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
 	}
+	if len(favoriteEmojis) > 0 {
+		favoriteEmoji = favoriteEmojis[0].EmojiName
+	}
+
+	// ユーザが送ったリアクション数
+	var reactionsGiven int64
+	if err := tx.GetContext(ctx, &reactionsGiven, "SELECT COUNT(*) FROM reactions WHERE user_id = ?", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions given: "+err.Error())
+	}
+
+	// 累計視聴時間
+	watchSeconds, err := getTotalWatchSeconds(ctx, tx, []int64{user.ID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum watch seconds: "+err.Error())
+	}
+
+	// 視聴者数の内訳
+	viewerCounts, err := getViewerCountsByOwner(ctx, tx, []int64{user.ID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count viewers: "+err.Error())
+	}
 
 	stats := UserStatistics{
 		Rank:              rank,
@@ -145,22 +216,172 @@ func getUserStatisticsHandler(c echo.Context) error {
 		TotalLivecomments: user.LiveComments,
 		TotalTip:          user.Tips,
 		FavoriteEmoji:     favoriteEmoji,
+		ReactionsGiven:    reactionsGiven,
+		TotalWatchSeconds: watchSeconds[user.ID],
+		ViewerCounts:      viewerCounts[user.ID],
 	}
 	return c.JSON(http.StatusOK, stats)
 }
 
-func getLivestreamStatisticsHandler(c echo.Context) error {
+type FavoriteEmoji struct {
+	EmojiName string `json:"emoji_name" db:"emoji_name"`
+	Count     int64  `json:"count" db:"count"`
+}
+
+const (
+	defaultFavoriteEmojiLimit = 10
+	maxFavoriteEmojiLimit     = 100
+)
+
+// ユーザごとのお気に入り絵文字を多い順に limit 件ずつ取得するクエリ
+// 同数の場合は絵文字名の降順
+// 単体・一括の統計とお気に入り絵文字APIのすべてでこのクエリを使い、並び順を揃える
+const favoriteEmojisQuery = `SELECT user_id, emoji_name, count FROM (
+		SELECT user_id, emoji_name, count, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY count DESC, emoji_name DESC) AS rn
+		FROM (SELECT user_id, emoji_name, COUNT(*) AS count FROM favorite_emojis WHERE user_id IN (?) GROUP BY user_id, emoji_name) counts
+	) ranked WHERE rn <= ? ORDER BY user_id, rn`
+
+// ユーザの配信に付いたリアクションの絵文字を多い順に取得する
+func getFavoriteEmojis(ctx context.Context, q sqlx.QueryerContext, userID int64, limit int) ([]FavoriteEmoji, error) {
+	emojis, err := getFavoriteEmojisByUserIDs(ctx, q, []int64{userID}, limit)
+	if err != nil {
+		return nil, err
+	}
+	if emojis[userID] == nil {
+		return []FavoriteEmoji{}, nil
+	}
+	return emojis[userID], nil
+}
+
+// 複数ユーザのお気に入り絵文字をまとめて取得する
+func getFavoriteEmojisByUserIDs(ctx context.Context, q sqlx.QueryerContext, userIDs []int64, limit int) (map[int64][]FavoriteEmoji, error) {
+	ret := make(map[int64][]FavoriteEmoji, len(userIDs))
+	if len(userIDs) == 0 {
+		return ret, nil
+	}
+	query, params, err := sqlx.In(favoriteEmojisQuery, userIDs, limit)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		UserID int64 `db:"user_id"`
+		FavoriteEmoji
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, query, params...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ret[row.UserID] = append(ret[row.UserID], row.FavoriteEmoji)
+	}
+	return ret, nil
+}
+
+// ユーザのお気に入り絵文字の上位N件
+// GET /api/user/:username/favorite-emojis
+func getUserFavoriteEmojisHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
-	id, err := strconv.Atoi(c.Param("livestream_id"))
+	limit := defaultFavoriteEmojiLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxFavoriteEmojiLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxFavoriteEmojiLimit))
+		}
+		limit = l
+	}
+
+	user, err := getUserByName(ctx, c.Param("username"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	emojis, err := getFavoriteEmojis(ctx, dbConn, user.ID, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get favorite emojis: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, emojis)
+}
+
+type UserTag struct {
+	ID    int64  `json:"id" db:"tag_id"`
+	Name  string `json:"name" db:"-"`
+	Count int64  `json:"count" db:"count"`
+}
+
+// ユーザの配信によく付いているタグを多い順に返す
+// 同数の場合はタグIDの昇順
+// GET /api/user/:username/tags
+func getUserTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	user, err := getUserByName(ctx, c.Param("username"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	tags := []UserTag{}
+	if err := dbConn.SelectContext(ctx, &tags, "SELECT lt.tag_id, COUNT(*) AS count FROM livestream_tags lt INNER JOIN livestreams l ON l.id = lt.livestream_id WHERE l.user_id = ? GROUP BY lt.tag_id ORDER BY count DESC, lt.tag_id ASC", user.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user tags: "+err.Error())
+	}
+	for i := range tags {
+		tags[i].Name = getTagName(tags[i].ID)
+	}
+
+	return c.JSON(http.StatusOK, tags)
+}
+
+const maxUserStatisticsBatchSize = 100
+
+type PostUserStatisticsBatchRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+type UserStatisticsBatchResponse struct {
+	Statistics map[string]UserStatistics `json:"statistics"`
+	NotFound   []string                  `json:"not_found"`
+}
+
+// 複数ユーザの統計情報をまとめて取得
+// POST /api/user/statistics/batch
+func postUserStatisticsBatchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostUserStatisticsBatchRequest
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+	}
+	if len(req.Usernames) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "usernames must not be empty")
+	}
+	if len(req.Usernames) > maxUserStatisticsBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("usernames must be at most %d", maxUserStatisticsBatchSize))
 	}
-	livestreamID := int64(id)
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -168,43 +389,162 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestream LivestreamModel
-	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+	query, params, err := sqlx.In("SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`reactions`,`tips`,`live_comments` FROM users WHERE name IN (?)", req.Usernames)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var users []*UserModel
+	if err := tx.SelectContext(ctx, &users, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	usersByName := make(map[string]*UserModel, len(users))
+	for _, user := range users {
+		usersByName[user.Name] = user
+	}
+
+	res := UserStatisticsBatchResponse{
+		Statistics: make(map[string]UserStatistics, len(req.Usernames)),
+		NotFound:   []string{},
+	}
+	var userIDs []int64
+	seen := make(map[string]struct{}, len(req.Usernames))
+	for _, username := range req.Usernames {
+		if _, ok := seen[username]; ok {
+			continue
+		}
+		seen[username] = struct{}{}
+
+		if user, ok := usersByName[username]; ok {
+			userIDs = append(userIDs, user.ID)
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			res.NotFound = append(res.NotFound, username)
 		}
 	}
 
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	viewersCounts := make(map[int64]int64, len(userIDs))
+	favoriteEmojis := make(map[int64]string, len(userIDs))
+	reactionsGiven := make(map[int64]int64, len(userIDs))
+	if len(userIDs) > 0 {
+		// 合計視聴者数
+		query, params, err = sqlx.In("SELECT l.user_id, COUNT(*) AS count FROM livestream_viewers_history h INNER JOIN livestreams l ON l.id = h.livestream_id WHERE l.user_id IN (?) AND h.ended_at IS NULL GROUP BY l.user_id", userIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var viewers []struct {
+			UserID int64 `db:"user_id"`
+			Count  int64 `db:"count"`
+		}
+		if err := tx.SelectContext(ctx, &viewers, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+		}
+		for _, v := range viewers {
+			viewersCounts[v.UserID] = v.Count
+		}
+
+		// お気に入り絵文字 (単体取得と同じクエリで先頭のもの)
+		emojis, err := getFavoriteEmojisByUserIDs(ctx, tx, userIDs, 1)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+		}
+		for userID, e := range emojis {
+			favoriteEmojis[userID] = e[0].EmojiName
+		}
+
+		// 送ったリアクション数
+		query, params, err = sqlx.In("SELECT user_id, COUNT(*) AS count FROM reactions WHERE user_id IN (?) GROUP BY user_id", userIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var given []struct {
+			UserID int64 `db:"user_id"`
+			Count  int64 `db:"count"`
+		}
+		if err := tx.SelectContext(ctx, &given, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions given: "+err.Error())
+		}
+		for _, g := range given {
+			reactionsGiven[g.UserID] = g.Count
+		}
 	}
 
-	// ランク算出
-	var ranking LivestreamRanking
-	for _, livestream := range livestreams {
-		score := livestream.Reactions + livestream.Tips
-		ranking = append(ranking, LivestreamRankingEntry{
-			LivestreamID: livestream.ID,
-			Score:        score,
-		})
+	// 累計視聴時間
+	watchSeconds, err := getTotalWatchSeconds(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum watch seconds: "+err.Error())
 	}
-	sort.Sort(ranking)
 
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.LivestreamID == livestreamID {
-			break
+	// 視聴者数の内訳
+	viewerCounts, err := getViewerCountsByOwner(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count viewers: "+err.Error())
+	}
+
+	for username := range seen {
+		user, ok := usersByName[username]
+		if !ok {
+			continue
+		}
+		rank, err := getUserRank(ctx, username)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
+		}
+		res.Statistics[username] = UserStatistics{
+			Rank:              rank,
+			ViewersCount:      viewersCounts[user.ID],
+			TotalReactions:    user.Reactions,
+			TotalLivecomments: user.LiveComments,
+			TotalTip:          user.Tips,
+			FavoriteEmoji:     favoriteEmojis[user.ID],
+			ReactionsGiven:    reactionsGiven[user.ID],
+			TotalWatchSeconds: watchSeconds[user.ID],
+			ViewerCounts:      viewerCounts[user.ID],
 		}
-		rank++
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func getLivestreamStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreams, err := getLivestreamsByIDs(ctx, tx, []int64{livestreamID})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	livestream, ok := livestreams[livestreamID]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "cannot get stats of not found livestream")
+	}
+
+	// ランク算出
+	rank, err := getLivestreamRank(ctx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ranking: "+err.Error())
 	}
 
 	// 視聴者数算出
 	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ? AND h.ended_at IS NULL`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+	var viewerCounts ViewerCounts
+	if err := tx.GetContext(ctx, &viewerCounts, "SELECT "+viewerCountsColumns+" FROM livestream_viewers_history h WHERE h.livestream_id = ?", liveViewerThreshold(), livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
 
@@ -224,5 +564,240 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		MaxTip:         livestream.MaxTip,
 		TotalReactions: livestream.Reactions,
 		TotalReports:   totalReports,
+		ViewerCounts:   viewerCounts,
 	})
 }
+
+type PopularEmoji struct {
+	EmojiName string `json:"emoji_name" db:"emoji_name"`
+	Count     int64  `json:"count" db:"count"`
+}
+
+const (
+	defaultPopularEmojiLimit = 10
+	maxPopularEmojiLimit     = 100
+	popularEmojiCacheTTL     = 5 * time.Second
+)
+
+var popularEmojiCache = gocache.New(gocache.WithExpireAt(popularEmojiCacheTTL))
+
+// サービス全体で人気の絵文字ランキング
+// GET /api/emoji/popular
+func getPopularEmojisHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultPopularEmojiLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxPopularEmojiLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxPopularEmojiLimit))
+		}
+		limit = l
+	}
+
+	cacheKey := strconv.Itoa(limit)
+	if emojis, found := popularEmojiCache.Get(cacheKey); found {
+		return c.JSON(http.StatusOK, emojis.([]PopularEmoji))
+	}
+
+	emojis := []PopularEmoji{}
+	if err := dbConn.SelectContext(ctx, &emojis, "SELECT emoji_name, COUNT(*) AS count FROM reactions GROUP BY emoji_name ORDER BY count DESC, emoji_name ASC LIMIT ?", limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get popular emojis: "+err.Error())
+	}
+	popularEmojiCache.Set(cacheKey, emojis)
+
+	return c.JSON(http.StatusOK, emojis)
+}
+
+const (
+	defaultTrendingEmojiWindow = 3600
+	maxTrendingEmojiWindow     = 24 * 3600
+	maxTrendingEmojiLimit      = 100
+	trendingEmojiCacheTTL      = 5 * time.Second
+)
+
+var trendingEmojiCache = gocache.New(gocache.WithExpireAt(trendingEmojiCacheTTL))
+
+// 直近window秒間に使われた絵文字のランキング
+// GET /api/emoji/trending
+func getTrendingEmojisHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	window := defaultTrendingEmojiWindow
+	if c.QueryParam("window") != "" {
+		w, err := strconv.Atoi(c.QueryParam("window"))
+		if err != nil || w < 1 || w > maxTrendingEmojiWindow {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("window query parameter must be integer between 1 and %d", maxTrendingEmojiWindow))
+		}
+		window = w
+	}
+	limit := defaultPopularEmojiLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxTrendingEmojiLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxTrendingEmojiLimit))
+		}
+		limit = l
+	}
+
+	cacheKey := fmt.Sprintf("%d:%d", window, limit)
+	if emojis, found := trendingEmojiCache.Get(cacheKey); found {
+		return c.JSON(http.StatusOK, emojis.([]PopularEmoji))
+	}
+
+	since := time.Now().Unix() - int64(window)
+	emojis := []PopularEmoji{}
+	if err := dbConn.SelectContext(ctx, &emojis, "SELECT emoji_name, COUNT(*) AS count FROM reactions WHERE created_at >= ? GROUP BY emoji_name ORDER BY count DESC, emoji_name ASC LIMIT ?", since, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get trending emojis: "+err.Error())
+	}
+	trendingEmojiCache.Set(cacheKey, emojis)
+
+	return c.JSON(http.StatusOK, emojis)
+}
+
+const (
+	defaultTrendingLivestreamWindow = 3600
+	maxTrendingLivestreamWindow     = 24 * 3600
+	defaultTrendingLivestreamLimit  = 10
+	maxTrendingLivestreamLimit      = 100
+	trendingLivestreamCacheTTL      = 5 * time.Second
+)
+
+var trendingLivestreamCache = gocache.New(gocache.WithExpireAt(trendingLivestreamCacheTTL))
+
+type TrendingLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	// 直近window秒間のリアクション数
+	Reactions int64 `json:"reactions"`
+}
+
+// 直近window秒間のリアクション数が多いライブ配信のランキング
+// livestreams.reactions は全期間の累計なので使えず、reactions.created_at から都度集計する
+// GET /api/livestream/trending
+func getTrendingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	window := defaultTrendingLivestreamWindow
+	if c.QueryParam("window") != "" {
+		w, err := strconv.Atoi(c.QueryParam("window"))
+		if err != nil || w < 1 || w > maxTrendingLivestreamWindow {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("window query parameter must be integer between 1 and %d", maxTrendingLivestreamWindow))
+		}
+		window = w
+	}
+	limit := defaultTrendingLivestreamLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxTrendingLivestreamLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxTrendingLivestreamLimit))
+		}
+		limit = l
+	}
+
+	cacheKey := fmt.Sprintf("%d:%d", window, limit)
+	if livestreams, found := trendingLivestreamCache.Get(cacheKey); found {
+		return c.JSON(http.StatusOK, livestreams.([]TrendingLivestream))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	since := time.Now().Unix() - int64(window)
+	var counts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Reactions    int64 `db:"reactions"`
+	}
+	if err := tx.SelectContext(ctx, &counts, "SELECT livestream_id, COUNT(*) AS reactions FROM reactions WHERE created_at >= ? GROUP BY livestream_id ORDER BY reactions DESC, livestream_id DESC LIMIT ?", since, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	livestreams := make([]TrendingLivestream, 0, len(counts))
+	if len(counts) > 0 {
+		livestreamIDs := make([]int64, len(counts))
+		for i, count := range counts {
+			livestreamIDs[i] = count.LivestreamID
+		}
+		livestreamModels, err := getLivestreamsByIDs(ctx, tx, livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+
+		ownerIDs := make([]int64, 0, len(livestreamModels))
+		for _, livestreamModel := range livestreamModels {
+			ownerIDs = append(ownerIDs, livestreamModel.UserID)
+		}
+		owners, err := getUsersWithCache(ctx, tx, ownerIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream owners: "+err.Error())
+		}
+
+		tags, err := loadTagsForLivestreams(ctx, tx, livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+
+		for _, count := range counts {
+			livestreamModel, ok := livestreamModels[count.LivestreamID]
+			if !ok {
+				continue
+			}
+			owner, ok := owners[livestreamModel.UserID]
+			if !ok {
+				continue
+			}
+			livestream, err := fillLivestreamResponse(ctx, livestreamModel, owner, tags[livestreamModel.ID])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+			}
+			livestreams = append(livestreams, TrendingLivestream{
+				Livestream: livestream,
+				Reactions:  count.Reactions,
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	trendingLivestreamCache.Set(cacheKey, livestreams)
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+type StatsOverview struct {
+	LiveNow        int64 `json:"live_now" db:"live_now"`
+	TotalUsers     int64 `json:"total_users" db:"total_users"`
+	TotalReactions int64 `json:"total_reactions" db:"total_reactions"`
+}
+
+const (
+	statsOverviewCacheKey = "overview"
+	statsOverviewCacheTTL = 3 * time.Second
+)
+
+var statsOverviewCache = gocache.New(gocache.WithExpireAt(statsOverviewCacheTTL))
+
+// トップページ用のサービス全体の概況
+// GET /api/stats/overview
+func getStatsOverviewHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if overview, found := statsOverviewCache.Get(statsOverviewCacheKey); found {
+		return c.JSON(http.StatusOK, overview.(*StatsOverview))
+	}
+
+	now := time.Now().Unix()
+	var overview StatsOverview
+	if err := dbConn.GetContext(ctx, &overview, `SELECT
+		(SELECT COUNT(*) FROM livestreams WHERE start_at <= ? AND end_at >= ?) AS live_now,
+		(SELECT COUNT(*) FROM users) AS total_users,
+		(SELECT COUNT(*) FROM reactions) AS total_reactions`, now, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get stats overview: "+err.Error())
+	}
+	statsOverviewCache.Set(statsOverviewCacheKey, &overview)
+
+	return c.JSON(http.StatusOK, &overview)
+}
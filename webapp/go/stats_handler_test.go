@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetLivestreamStatisticsNotFound(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM livestreams WHERE id IN (?)")).
+		WithArgs(404).
+		WillReturnRows(livestreamRows())
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodGet, "/api/livestream/404/statistics", nil)
+	withLoginSession(c, 1, "viewer")
+	withParams(c, "livestream_id", "404")
+	if got := statusOf(getLivestreamStatisticsHandler(c), rec); got != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestGetUserStatisticsNotFound(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE name = ?")).
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+
+	c, rec := newTestContext(http.MethodGet, "/api/user/nobody/statistics", nil)
+	withLoginSession(c, 1, "viewer")
+	withParams(c, "username", "nobody")
+	if got := statusOf(getUserStatisticsHandler(c), rec); got != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestGetPopularEmojis(t *testing.T) {
+	mock := setupMockDB(t)
+	// 集計と並び替えはDBで行う。件数の多い順、同数なら絵文字名の昇順
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT emoji_name, COUNT(*) AS count FROM reactions GROUP BY emoji_name ORDER BY count DESC, emoji_name ASC LIMIT ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"emoji_name", "count"}).
+			AddRow("innocent", 5).
+			AddRow("smile", 2).
+			AddRow("tada", 2))
+
+	want := []PopularEmoji{{"innocent", 5}, {"smile", 2}, {"tada", 2}}
+	// 2回目はキャッシュから返るのでDBは引かない
+	for i := 0; i < 2; i++ {
+		c, rec := newTestContext(http.MethodGet, "/api/emoji/popular?limit=3", nil)
+		if err := getPopularEmojisHandler(c); err != nil {
+			t.Fatal(err)
+		}
+		var got []PopularEmoji
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("emojis = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGetPopularEmojisLimit(t *testing.T) {
+	for _, limit := range []string{"0", "-1", "101", "abc"} {
+		t.Run(limit, func(t *testing.T) {
+			setupMockDB(t)
+			c, rec := newTestContext(http.MethodGet, "/api/emoji/popular?limit="+limit, nil)
+			if got := statusOf(getPopularEmojisHandler(c), rec); got != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// 単体取得と一括取得で、同数の絵文字の並び順が一致する
+func TestFavoriteEmojisSharedOrder(t *testing.T) {
+	db := setupTestMySQL(t)
+	execForTest(t, db,
+		"INSERT INTO favorite_emojis (user_id, emoji_name) VALUES (1, 'a'), (1, 'a'), (1, 'b'), (1, 'b'), (1, 'c'), (2, 'z'), (2, 'y'), (2, 'y'), (2, 'y')",
+	)
+	ctx := context.Background()
+
+	single, err := getFavoriteEmojis(ctx, db, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []FavoriteEmoji{{"b", 2}, {"a", 2}, {"c", 1}}; !reflect.DeepEqual(single, want) {
+		t.Errorf("favorite emojis = %+v, want %+v", single, want)
+	}
+
+	batch, err := getFavoriteEmojisByUserIDs(ctx, db, []int64{1, 2, 3}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int64][]FavoriteEmoji{1: {{"b", 2}}, 2: {{"y", 3}}}; !reflect.DeepEqual(batch, want) {
+		t.Errorf("batch favorite emojis = %+v, want %+v", batch, want)
+	}
+
+	none, err := getFavoriteEmojis(ctx, db, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(none) != 0 || none == nil {
+		t.Errorf("favorite emojis of user without reactions = %#v, want empty", none)
+	}
+}
@@ -1,3 +1,87 @@
 package main
 
-var TAGS = map[int64]string{1: "ライブ配信", 2: "ゲーム実況", 3: "生放送", 4: "アドバイス", 5: "初心者歓迎", 6: "プロゲーマー", 7: "新作ゲーム", 8: "レトロゲーム", 9: "RPG", 10: "FPS", 11: "アクションゲーム", 12: "対戦ゲーム", 13: "マルチプレイ", 14: "シングルプレイ", 15: "ゲーム解説", 16: "ホラーゲーム", 17: "イベント生放送", 18: "新情報発表", 19: "Q&Aセッション", 20: "チャット交流", 21: "視聴者参加", 22: "音楽ライブ", 23: "カバーソング", 24: "オリジナル楽曲", 25: "アコースティック", 26: "歌配信", 27: "楽器演奏", 28: "ギター", 29: "ピアノ", 30: "バンドセッション", 31: "DJセット", 32: "トーク配信", 33: "朝活", 34: "夜ふかし", 35: "日常話", 36: "趣味の話", 37: "語学学習", 38: "お料理配信", 39: "手料理", 40: "レシピ紹介", 41: "アート配信", 42: "絵描き", 43: "DIY", 44: "手芸", 45: "アニメトーク", 46: "映画レビュー", 47: "読書感想", 48: "ファッション", 49: "メイク", 50: "ビューティー", 51: "健康", 52: "ワークアウト", 53: "ヨガ", 54: "ダンス", 55: "旅行記", 56: "アウトドア", 57: "キャンプ", 58: "ペットと一緒", 59: "猫", 60: "犬", 61: "釣り", 62: "ガーデニング", 63: "テクノロジー", 64: "ガジェット紹介", 65: "プログラミング", 66: "DIY電子工作", 67: "ニュース解説", 68: "歴史", 69: "文化", 70: "社会問題", 71: "心理学", 72: "宇宙", 73: "科学", 74: "マジック", 75: "コメディ", 76: "スポーツ", 77: "サッカー", 78: "野球", 79: "バスケットボール", 80: "ライフハック", 81: "教育", 82: "子育て", 83: "ビジネス", 84: "起業", 85: "投資", 86: "仮想通貨", 87: "株式投資", 88: "不動産", 89: "キャリア", 90: "スピリチュアル", 91: "占い", 92: "手相", 93: "オカルト", 94: "UFO", 95: "都市伝説", 96: "コンサート", 97: "ファンミーティング", 98: "コラボ配信", 99: "記念配信", 100: "生誕祭", 101: "周年記念", 102: "サプライズ", 103: "椅子"}
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hlts2/gocache"
+	"github.com/labstack/echo/v4"
+)
+
+// タグIDからタグ名への対応表
+// 起動時とinitialize時にtagsテーブルから読み込む
+var (
+	TAGS    = map[int64]string{}
+	tagList = []*Tag{}
+	// タグ一覧APIのETag (IDと名前から計算する)
+	tagsETag string
+	tagsMtx  sync.RWMutex
+)
+
+func loadTags(ctx context.Context) error {
+	var tagModels []*TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT id, name FROM tags"); err != nil {
+		return err
+	}
+	sort.Slice(tagModels, func(i, j int) bool { return tagModels[i].ID < tagModels[j].ID })
+
+	tags := make(map[int64]string, len(tagModels))
+	list := make([]*Tag, len(tagModels))
+	hash := sha256.New()
+	for i, tag := range tagModels {
+		tags[tag.ID] = tag.Name
+		list[i] = &Tag{
+			ID:   tag.ID,
+			Name: tag.Name,
+		}
+		fmt.Fprintf(hash, "%d\x00%s\x00", tag.ID, tag.Name)
+	}
+
+	tagsMtx.Lock()
+	defer tagsMtx.Unlock()
+	TAGS = tags
+	tagList = list
+	tagsETag = fmt.Sprintf("\"%x\"", hash.Sum(nil))
+	return nil
+}
+
+func getTagName(tagID int64) string {
+	tagsMtx.RLock()
+	defer tagsMtx.RUnlock()
+	return TAGS[tagID]
+}
+
+func getTagList() ([]*Tag, string) {
+	tagsMtx.RLock()
+	defer tagsMtx.RUnlock()
+	return tagList, tagsETag
+}
+
+// gzipミドルウェアと同じく Accept-Encoding を見て、圧縮を受け付けるクライアントかを判定する
+func acceptsGzip(r *http.Request) bool {
+	return strings.Contains(r.Header.Get(echo.HeaderAcceptEncoding), "gzip")
+}
+
+// 圧縮したレスポンス用のETag
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, "\"") + "-gzip\""
+}
+
+// ライブ配信ごとのタグIDのキャッシュ
+// タグは予約時に決まり以降変わらないので、予約時に無効化すればよい
+var livestreamTagsCache = gocache.New(gocache.WithExpireAt(60 * time.Minute))
+
+func livestreamTagsCacheKey(livestreamID int64) string {
+	return strconv.FormatInt(livestreamID, 10)
+}
+
+func invalidateLivestreamTags(livestreamID int64) {
+	livestreamTagsCache.Delete(livestreamTagsCacheKey(livestreamID))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// loadTagsで書き換わるタグの対応表をテスト後に戻す
+func restoreTags(t *testing.T) {
+	tagsMtx.RLock()
+	tags, list, etag := TAGS, tagList, tagsETag
+	tagsMtx.RUnlock()
+	t.Cleanup(func() {
+		tagsMtx.Lock()
+		defer tagsMtx.Unlock()
+		TAGS, tagList, tagsETag = tags, list, etag
+	})
+}
+
+func TestLoadTagsRefresh(t *testing.T) {
+	mock := setupMockDB(t)
+	restoreTags(t)
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name FROM tags")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(2, "ゲーム実況").AddRow(1, "ライブ配信"))
+	if err := loadTags(ctx); err != nil {
+		t.Fatal(err)
+	}
+	list, etag := getTagList()
+	if want := []*Tag{{ID: 1, Name: "ライブ配信"}, {ID: 2, Name: "ゲーム実況"}}; !reflect.DeepEqual(list, want) {
+		t.Errorf("tags = %+v, want %+v", list, want)
+	}
+
+	// initializeでタグが入れ替わった
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name FROM tags")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "雑談").AddRow(3, "歌枠"))
+	if err := loadTags(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int64]string{1: "雑談", 2: "", 3: "歌枠"} {
+		if got := getTagName(id); got != want {
+			t.Errorf("getTagName(%d) = %q, want %q", id, got, want)
+		}
+	}
+	list, newETag := getTagList()
+	if want := []*Tag{{ID: 1, Name: "雑談"}, {ID: 3, Name: "歌枠"}}; !reflect.DeepEqual(list, want) {
+		t.Errorf("tags = %+v, want %+v", list, want)
+	}
+	if newETag == etag {
+		t.Errorf("ETag was not updated: %s", etag)
+	}
+}
+
+// gzipで返すタグ一覧は、非圧縮のものと別のETagになる
+func TestGetTagHandlerGzipETag(t *testing.T) {
+	restoreTags(t)
+	list := make([]*Tag, 100)
+	for i := range list {
+		list[i] = &Tag{ID: int64(i + 1), Name: fmt.Sprintf("タグ%d", i+1)}
+	}
+	tagsMtx.Lock()
+	tagList, tagsETag = list, `"tags"`
+	tagsMtx.Unlock()
+
+	e := echo.New()
+	e.Use(middleware.GzipWithConfig(gzipConfig()))
+	e.GET("/api/tag", getTagHandler)
+	get := func(acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/tag", nil)
+		if acceptEncoding != "" {
+			req.Header.Set(echo.HeaderAcceptEncoding, acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	identity := get("", "")
+	gzipped := get("gzip", "")
+	if got := gzipped.Header().Get(echo.HeaderContentEncoding); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	identityETag, gzippedETag := identity.Header().Get("ETag"), gzipped.Header().Get("ETag")
+	if identityETag == gzippedETag {
+		t.Fatalf("gzip and identity responses share ETag %s", identityETag)
+	}
+
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		ifNoneMatch    string
+		want           int
+	}{
+		{"identity matches", "", identityETag, http.StatusNotModified},
+		{"gzip matches", "gzip", gzippedETag, http.StatusNotModified},
+		{"gzip etag on identity request", "", gzippedETag, http.StatusOK},
+		{"identity etag on gzip request", "gzip", identityETag, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := get(tc.acceptEncoding, tc.ifNoneMatch).Code; got != tc.want {
+				t.Errorf("status = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// 圧縮しないのはアイコン画像の取得とWebSocketだけ
+func TestGzipSkipper(t *testing.T) {
+	body := strings.Repeat("a", gzipMinLength)
+	handler := func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{"body": body})
+	}
+	e := echo.New()
+	e.Use(middleware.GzipWithConfig(gzipConfig()))
+	e.GET("/api/user/:username/icon", handler)
+	e.POST("/api/icon", handler)
+	e.DELETE("/api/user/:username/icon", handler)
+
+	cases := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/api/user/streamer/icon", ""},
+		{http.MethodPost, "/api/icon", "gzip"},
+		{http.MethodDelete, "/api/user/streamer/icon", "gzip"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if got := rec.Header().Get(echo.HeaderContentEncoding); got != tc.want {
+				t.Errorf("Content-Encoding = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
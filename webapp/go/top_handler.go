@@ -3,8 +3,10 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -23,20 +25,17 @@ type TagsResponse struct {
 }
 
 func getTagHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-
-	var tagModels []*TagModel
-	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT id, name FROM tags"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	// タグはinitialize時にしか変わらないのでメモリ上のものを返す
+	tags, etag := getTagList()
+	// gzipで返す場合は中身が変わるので、別のETagにする
+	if acceptsGzip(c.Request()) {
+		etag = gzipETag(etag)
 	}
-
-	tags := make([]*Tag, len(tagModels))
-	for i := range tagModels {
-		tags[i] = &Tag{
-			ID:   tagModels[i].ID,
-			Name: tagModels[i].Name,
-		}
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
 	}
+
 	return c.JSON(http.StatusOK, &TagsResponse{
 		Tags: tags,
 	})
@@ -44,17 +43,14 @@ func getTagHandler(c echo.Context) error {
 
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
+// ログイン前の配信者ページの描画にも使うので、セッションは不要
+// レスポンスはユーザIDとダークモード設定のみで、セッションに依存する値は含まない
 func getStreamerThemeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		c.Logger().Printf("verifyUserSession: %+v\n", err)
-		return err
-	}
-
 	username := c.Param("username")
 
+	// getUserByNameはuserCacheにあればDBを引かない
 	userModel, err := getUserByName(ctx, username)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
@@ -68,5 +64,64 @@ func getStreamerThemeHandler(c echo.Context) error {
 		DarkMode: userModel.DarkMode,
 	}
 
+	// テーマはほとんど変わらないので、ブラウザにしばらくキャッシュさせる
+	c.Response().Header().Set(echo.HeaderCacheControl, "private, max-age=60")
 	return c.JSON(http.StatusOK, theme)
 }
+
+type ThemesResponse struct {
+	Themes   map[string]Theme `json:"themes"`
+	NotFound []string         `json:"not_found"`
+}
+
+const maxThemesUsernames = 100
+
+// 複数の配信者のテーマを一括取得するAPI
+// GET /api/themes?username=a&username=b
+func getThemesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	usernames := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, username := range c.QueryParams()["username"] {
+		if _, ok := seen[username]; ok || username == "" {
+			continue
+		}
+		seen[username] = struct{}{}
+		usernames = append(usernames, username)
+	}
+	if len(usernames) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "username query parameter is required")
+	}
+	if len(usernames) > maxThemesUsernames {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many usernames: at most %d", maxThemesUsernames))
+	}
+
+	query, params, err := sqlx.In("SELECT `id`, `name`, `dark_mode` FROM users WHERE name IN (?)", usernames)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var userModels []*UserModel
+	if err := dbConn.SelectContext(ctx, &userModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+
+	themes := make(map[string]Theme, len(userModels))
+	for _, userModel := range userModels {
+		themes[userModel.Name] = Theme{
+			ID:       userModel.ID,
+			DarkMode: userModel.DarkMode,
+		}
+	}
+	notFound := make([]string, 0)
+	for _, username := range usernames {
+		if _, ok := themes[username]; !ok {
+			notFound = append(notFound, username)
+		}
+	}
+
+	return c.JSON(http.StatusOK, &ThemesResponse{
+		Themes:   themes,
+		NotFound: notFound,
+	})
+}
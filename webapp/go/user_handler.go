@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
@@ -8,10 +9,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 	"github.com/hlts2/gocache"
@@ -19,6 +30,7 @@ import (
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -27,10 +39,33 @@ const (
 	defaultUserIDKey         = "USERID"
 	defaultUsernameKey       = "USERNAME"
 	bcryptDefaultCost        = bcrypt.MinCost
+	sessionDuration          = 1 * time.Hour
 )
 
 var fallbackImage = "../img/NoImage.jpg"
 
+// デフォルトのアイコン (fallbackImage) のハッシュ
+// users.icon_hash のデフォルト値と同じ
+var defaultIconHash = []byte{217, 248, 41, 78, 157, 137, 95, 129, 206, 98, 231, 61, 199, 213, 223, 248, 98, 164, 250, 64, 189, 78, 15, 236, 245, 63, 117, 38, 168, 237, 202, 192}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9-]{1,63}$`)
+
+// 登録できないユーザ名
+var reservedUsernames = map[string]struct{}{
+	"pipe": {},
+	// GET /api/user/id/:user_id と衝突するため
+	"id": {},
+	// GET /api/user/search と衝突するため
+	"search": {},
+	"ns1":    {},
+	"www":    {},
+}
+
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+)
+
 type UserModel struct {
 	ID             int64  `db:"id"`
 	Name           string `db:"name"`
@@ -51,6 +86,8 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// ?embed_icon=true の場合のみ、縮小したアイコンをdata URIで返す
+	IconDataURI string `json:"icon_data_uri,omitempty"`
 }
 
 type Theme struct {
@@ -83,6 +120,11 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type LoginResponse struct {
+	User      User  `json:"user"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
 type PostIconRequest struct {
 	Image []byte `json:"image"`
 }
@@ -91,9 +133,48 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
-var iconCache = gocache.New(gocache.WithExpireAt(60 * time.Minute))
+type DNSStatus struct {
+	Name     string `json:"name"`
+	Resolved bool   `json:"resolved"`
+}
+
+const isuDNSLookupTimeout = 1 * time.Second
+
+// テストでスタブのisudnsに向けられるよう変数にしている
+var (
+	isuDNSPort    = "53"
+	isuDNSAPIPort = "8082"
+)
+
+const (
+	iconCacheTTLEnvKey  = "ISUCON13_ICON_CACHE_TTL_MS"
+	defaultIconCacheTTL = 60 * time.Minute
+)
+
+// アイコンの更新時はpostIconHandler・deleteIconHandlerで明示的に消すので、TTLは長めでよい
+var iconCache = gocache.New(gocache.WithExpireAt(iconCacheTTL()))
 var userCache = gocache.New(gocache.WithExpireAt(60 * time.Minute))
 
+// キャッシュミス時に同じユーザ/アイコンへの読み込みが殺到しないようにまとめる
+var userLoadGroup singleflight.Group
+var iconLoadGroup singleflight.Group
+
+// ユーザの読み込みはリクエストのcontextと切り離して行うので、別にタイムアウトを設ける
+const userLoadTimeout = 5 * time.Second
+
+func iconCacheTTL() time.Duration {
+	v, ok := os.LookupEnv(iconCacheTTLEnvKey)
+	if !ok {
+		return defaultIconCacheTTL
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 1 {
+		log.Printf("invalid environment variable '%s': %s, fallback to %s", iconCacheTTLEnvKey, v, defaultIconCacheTTL)
+		return defaultIconCacheTTL
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 func getUsersWithCache(ctx context.Context, tx *sqlx.Tx, userId []int64) (map[int64]*UserModel, error) {
 	ret := make(map[int64]*UserModel)
 	userIds := make([]int64, 0)
@@ -145,15 +226,7 @@ func getUserWithCache(ctx context.Context, userId int64) (*UserModel, error) {
 		}
 	}
 
-	var userModel UserModel
-	if err := dbConn.GetContext(ctx, &userModel, "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users WHERE id = ?", userId); err != nil {
-		return nil, err
-	}
-
-	userCache.Set(fmt.Sprintf("id:%d", userId), &userModel)
-	userCache.Set(fmt.Sprintf("name:%s", userModel.Name), &userModel)
-	iconCache.Set(userModel.Name, userModel.IconHash)
-	return &userModel, nil
+	return loadUserShared(ctx, fmt.Sprintf("id:%d", userId), "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users WHERE id = ?", userId)
 }
 
 func getUserByName(ctx context.Context, userName string) (*UserModel, error) {
@@ -166,15 +239,35 @@ func getUserByName(ctx context.Context, userName string) (*UserModel, error) {
 		}
 	}
 
-	var userModel UserModel
-	if err := dbConn.GetContext(ctx, &userModel, "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users WHERE name = ?", userName); err != nil {
-		return nil, err
-	}
+	return loadUserShared(ctx, fmt.Sprintf("name:%s", userName), "SELECT `id`,`name`,`display_name`,`description`,`password`,`dark_mode`,`icon_hash` FROM users WHERE name = ?", userName)
+}
+
+// キャッシュミスしたユーザの読み込みを、同じキーで1回にまとめる
+// 読み込みは最初のリクエストのcontextと切り離し、そのリクエストがキャンセルされても待っている他のリクエストに結果を渡す
+func loadUserShared(ctx context.Context, key string, query string, arg interface{}) (*UserModel, error) {
+	ch := userLoadGroup.DoChan(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.Background(), userLoadTimeout)
+		defer cancel()
+
+		var userModel UserModel
+		if err := dbConn.GetContext(loadCtx, &userModel, query, arg); err != nil {
+			return nil, err
+		}
 
-	userCache.Set(fmt.Sprintf("id:%d", userModel.ID), &userModel)
-	userCache.Set(fmt.Sprintf("name:%s", userModel.Name), &userModel)
-	iconCache.Set(userModel.Name, userModel.IconHash)
-	return &userModel, nil
+		userCache.Set(fmt.Sprintf("id:%d", userModel.ID), &userModel)
+		userCache.Set(fmt.Sprintf("name:%s", userModel.Name), &userModel)
+		iconCache.Set(userModel.Name, userModel.IconHash)
+		return &userModel, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*UserModel), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func getIconHandler(c echo.Context) error {
@@ -184,10 +277,13 @@ func getIconHandler(c echo.Context) error {
 	c.Logger().Print(iconHash)
 
 	username := c.Param("username")
+	// WebPを受け付けるクライアントにはWebPで返す
+	wantWebP := acceptsWebP(c.Request())
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
 
 	if iconHash != "" {
 		cacheIconCacheHash, found := iconCache.Get(username)
-		if found && iconHash == fmt.Sprintf("\"%x\"", cacheIconCacheHash.([]byte)) {
+		if found && iconHash == iconETag(cacheIconCacheHash.([]byte), wantWebP) {
 			return c.NoContent(http.StatusNotModified)
 		}
 	}
@@ -200,49 +296,77 @@ func getIconHandler(c echo.Context) error {
 	}
 
 	if iconHash != "" {
-		if fmt.Sprintf("\"%x\"", user.IconHash) == iconHash {
+		if iconETag(user.IconHash, wantWebP) == iconHash {
 			return c.NoContent(http.StatusNotModified)
 		}
 	}
 
-	if _, err := os.Stat(fmt.Sprintf("/home/isucon/icons/%x", user.IconHash)); err != nil {
+	if _, err := os.Stat(filepath.Join(iconDir, fmt.Sprintf("%x", user.IconHash))); err != nil {
 		return c.File(fallbackImage)
 	}
 
-	image, err := os.ReadFile(fmt.Sprintf("/home/isucon/icons/%x", user.IconHash))
+	if wantWebP {
+		if image, ok := loadWebPIcon(user); ok {
+			c.Response().Header().Set("ETag", iconETag(user.IconHash, true))
+			return c.Blob(http.StatusOK, "image/webp", image)
+		}
+		// 変換できなければJPEGで返す
+	}
+
+	image, err := loadIcon(user)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
 	}
 
+	c.Response().Header().Set("ETag", iconETag(user.IconHash, false))
 	return c.Blob(http.StatusOK, "image/jpeg", image)
 }
 
+// 同じユーザのアイコンへの同時リクエストは1回の読み込みを共有する
+func loadIcon(user *UserModel) ([]byte, error) {
+	v, err, _ := iconLoadGroup.Do(fmt.Sprintf("%d:%x", user.ID, user.IconHash), func() (interface{}, error) {
+		return os.ReadFile(filepath.Join(iconDir, fmt.Sprintf("%x", user.IconHash)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
-
-	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
-	}
+	var iconHash []byte
+	if mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType)); mediaType == echo.MIMEMultipartForm {
+		// multipart/form-data の image パートをそのままファイルに書き出す
+		h, err := saveMultipartIcon(c)
+		if err != nil {
+			return err
+		}
+		iconHash = h
+	} else {
+		var req *PostIconRequest
+		if err := decodeRequestBody(c, &req); err != nil {
+			return err
+		}
+		if req == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "request body must not be null")
+		}
 
-	// imageのsha256を計算
-	hash := sha256.New()
-	// hash doesn't returns error
-	_, _ = hash.Write(req.Image)
-	iconHash := hash.Sum(nil)
+		// imageのsha256を計算
+		hash := sha256.New()
+		// hash doesn't returns error
+		_, _ = hash.Write(req.Image)
+		iconHash = hash.Sum(nil)
 
-	if err := os.WriteFile(fmt.Sprintf("/home/isucon/icons/%x", iconHash), req.Image, 0644); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save image: "+err.Error())
+		if err := os.WriteFile(filepath.Join(iconDir, fmt.Sprintf("%x", iconHash)), req.Image, 0644); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to save image: "+err.Error())
+		}
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -258,9 +382,11 @@ func postIconHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("tx error: %w", err)
 	}
+	// 古いアイコンのハッシュを返さないよう、キャッシュを明示的に消す
 	user, err := getUserWithCache(ctx, userID)
 	if err == nil {
 		iconCache.Delete(user.Name)
+		c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/user/%s/icon", url.PathEscape(user.Name)))
 	}
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
@@ -268,18 +394,134 @@ func postIconHandler(c echo.Context) error {
 	})
 }
 
-func getMeHandler(c echo.Context) error {
+// アイコンを削除してデフォルトのアイコンに戻す
+// アイコンのファイルは同じ画像を使う他のユーザと共有されるので消さない
+// DELETE /api/user/:username/icon
+func deleteIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID, err := currentUserID(c)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	username := c.Param("username")
+	user, err := getUserWithCache(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if user.Name != username {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other user's icon")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "UPDATE users SET icon_hash = ? WHERE id = ? AND icon_hash <> ?", defaultIconHash, userID, defaultIconHash)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset user icon: "+err.Error())
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if affected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "the user has no custom icon")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user icon: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	// 古いアイコンのハッシュを返さないよう、キャッシュを明示的に消す
+	iconCache.Delete(user.Name)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+const maxIconSize = 8 << 20
+
+// multipartでアップロードできる画像の形式
+var allowedIconTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+	"image/webp": {},
+}
+
+// imageパートを一時ファイルに書き出しながらハッシュを計算し、ハッシュ名のファイルにリネームする
+func saveMultipartIcon(c echo.Context) ([]byte, error) {
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read multipart body: "+err.Error())
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "image part is required")
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read multipart body: "+err.Error())
+		}
+		if part.FormName() != "image" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		br := bufio.NewReaderSize(io.LimitReader(part, maxIconSize+1), 512)
+		head, err := br.Peek(512)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read image: "+err.Error())
+		}
+		if _, ok := allowedIconTypes[http.DetectContentType(head)]; !ok {
+			return nil, echo.NewHTTPError(http.StatusUnsupportedMediaType, "image must be jpeg, png, gif or webp")
+		}
+
+		tmp, err := os.CreateTemp(iconDir, "upload-*")
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to save image: "+err.Error())
+		}
+		defer os.Remove(tmp.Name())
+
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(tmp, hash), br)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to save image: "+err.Error())
+		}
+		if n > maxIconSize {
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("image must be at most %d bytes", maxIconSize))
+		}
+
+		iconHash := hash.Sum(nil)
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to save image: "+err.Error())
+		}
+		if err := os.Rename(tmp.Name(), filepath.Join(iconDir, fmt.Sprintf("%x", iconHash))); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to save image: "+err.Error())
+		}
+		return iconHash, nil
+	}
+}
+
+func getMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
 
 	userModel, err := getUserWithCache(ctx, userID)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -293,6 +535,11 @@ func getMeHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
+	if wantsEmbeddedIcon(c) {
+		if err := embedUserIcons([]*User{&user}); err != nil {
+			return err
+		}
+	}
 
 	return c.JSON(http.StatusOK, user)
 }
@@ -304,12 +551,16 @@ func registerHandler(c echo.Context) error {
 	defer c.Request().Body.Close()
 
 	req := PostUserRequest{}
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
 	}
 
-	if req.Name == "pipe" {
-		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
+	// ユーザ名は <name>.u.isucon.dev. のDNSラベルになる
+	if !usernamePattern.MatchString(req.Name) || strings.HasPrefix(req.Name, "-") || strings.HasSuffix(req.Name, "-") {
+		return echo.NewHTTPError(http.StatusBadRequest, "the username must be 1-63 characters of lowercase letters, digits and hyphens, and must not start or end with a hyphen")
+	}
+	if _, reserved := reservedUsernames[req.Name]; reserved {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the username '%s' is reserved", req.Name))
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
@@ -329,11 +580,15 @@ func registerHandler(c echo.Context) error {
 		Description:    req.Description,
 		HashedPassword: string(hashedPassword),
 		DarkMode:       req.Theme.DarkMode,
-		IconHash:       []byte{217, 248, 41, 78, 157, 137, 95, 129, 206, 98, 231, 61, 199, 213, 223, 248, 98, 164, 250, 64, 189, 78, 15, 236, 245, 63, 117, 38, 168, 237, 202, 192},
+		IconHash:       defaultIconHash,
 	}
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password, dark_mode) VALUES(:name, :display_name, :description, :password, :dark_mode)", userModel)
 	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+			return newCodedHTTPError(http.StatusConflict, errCodeUsernameTaken, "the username is already taken")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
 	}
 
@@ -357,30 +612,22 @@ func registerHandler(c echo.Context) error {
 	//}
 
 	// send to http request to isudns
-	type RecordCreateParam struct {
-		Username string `json:"username"`
-	}
-	param := RecordCreateParam{
-		Username: req.Name,
-	}
-	b, err := json.Marshal(param)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to marshal json: "+err.Error())
-	}
-
-	client := &http.Client{}
-	reqIsuDNS, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s:8082/api/record", isuDNSServerAddress), bytes.NewBuffer(b))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create request: "+err.Error())
-	}
-	resp, err := client.Do(reqIsuDNS)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to send request: "+err.Error())
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
-		return echo.NewHTTPError(http.StatusInternalServerError, "invalid response from isudns: %s", resp.Body)
-	}
+	if err := requestIsuDNSRecord(ctx, http.MethodPost, req.Name, http.StatusCreated); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	// コミットまで到達しなかった場合はisudnsのレコードを取り消す
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		// リクエストのcontextはキャンセルされている可能性があるので別のcontextを使う
+		ctx, cancel := context.WithTimeout(context.Background(), isuDNSRollbackTimeout)
+		defer cancel()
+		if err := requestIsuDNSRecord(ctx, http.MethodDelete, req.Name, http.StatusNoContent); err != nil {
+			c.Logger().Errorf("failed to roll back isudns record for %s: %v", req.Name, err)
+		}
+	}()
 
 	user, err := fillUserResponse(ctx, &userModel)
 	if err != nil {
@@ -390,10 +637,42 @@ func registerHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	committed = true
 
 	return c.JSON(http.StatusCreated, user)
 }
 
+// isudnsのレコードを作成・削除する
+func requestIsuDNSRecord(ctx context.Context, method string, username string, expectedStatus int) error {
+	type RecordParam struct {
+		Username string `json:"username"`
+	}
+	b, err := json.Marshal(RecordParam{
+		Username: username,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal json: %w", err)
+	}
+
+	reqIsuDNS, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s/api/record", net.JoinHostPort(isuDNSServerAddress, isuDNSAPIPort)), bytes.NewBuffer(b))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if isuDNSToken != "" {
+		reqIsuDNS.Header.Set(isuDNSTokenHeader, isuDNSToken)
+	}
+	resp, err := http.DefaultClient.Do(reqIsuDNS)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("invalid response from isudns: %d %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
 // ユーザログインAPI
 // POST /api/login
 func loginHandler(c echo.Context) error {
@@ -401,38 +680,42 @@ func loginHandler(c echo.Context) error {
 	defer c.Request().Body.Close()
 
 	req := LoginRequest{}
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeRequestBody(c, &req); err != nil {
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	userKey, ipKey := "user:"+req.Username, "ip:"+c.RealIP()
+	if loginFailuresByUser.Blocked(userKey) || loginFailuresByIP.Blocked(ipKey) {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed login attempts")
 	}
-	defer tx.Rollback()
 
 	// usernameはUNIQUEなので、whereで一意に特定できる
+	// キャッシュ経由の読み取りなのでトランザクションは張らない
 	userModel, err := getUserByName(ctx, req.Username)
 	if errors.Is(err, sql.ErrNoRows) {
+		// 存在しないユーザでもパスワードの比較を行う
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(req.Password))
+		loginFailuresByUser.RecordFailure(userKey)
+		loginFailuresByIP.RecordFailure(ipKey)
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
 	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
+		loginFailuresByUser.RecordFailure(userKey)
+		loginFailuresByIP.RecordFailure(ipKey)
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
+	// IPの失敗回数は戻さない (自分のアカウントへのログインを挟んで総当たりを続けられないように)
+	loginFailuresByUser.Reset(userKey)
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	sessionEndAt := time.Now().Add(sessionDuration)
 
 	sessionID := uuid.NewString()
 
@@ -442,8 +725,8 @@ func loginHandler(c echo.Context) error {
 	}
 
 	sess.Options = &sessions.Options{
-		Domain: "u.isucon.dev",
-		MaxAge: int(60000),
+		Domain: cookieDomain,
+		MaxAge: int(sessionDuration.Seconds()),
 		Path:   "/",
 	}
 	sess.Values[defaultSessionIDKey] = sessionID
@@ -455,7 +738,19 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
 
-	return c.NoContent(http.StatusOK)
+	if !loginResponseWithExpiry {
+		return c.NoContent(http.StatusOK)
+	}
+
+	user, err := fillUserResponse(ctx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &LoginResponse{
+		User:      user,
+		ExpiresAt: sessionEndAt.Unix(),
+	})
 }
 
 // ユーザ詳細API
@@ -487,6 +782,11 @@ func getUserHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
+	if wantsEmbeddedIcon(c) {
+		if err := embedUserIcons([]*User{&user}); err != nil {
+			return err
+		}
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
@@ -495,6 +795,163 @@ func getUserHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// ユーザ名か表示名の前方一致でユーザを検索する
+// GET /api/user/search
+func searchUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	q := c.QueryParam("q")
+	if q == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter must not be empty")
+	}
+	limit := defaultUserSearchLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxUserSearchLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be integer between 1 and %d", maxUserSearchLimit))
+		}
+		limit = l
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 予約済みのpipeユーザは検索結果に含めない
+	prefix := escapeLike(q) + "%"
+	var userIDs []int64
+	if err := tx.SelectContext(ctx, &userIDs, "SELECT id FROM users WHERE (name LIKE ? OR display_name LIKE ?) AND name <> 'pipe' ORDER BY name LIMIT ?", prefix, prefix, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to search users: "+err.Error())
+	}
+	userModels, err := getUsersWithCache(ctx, tx, userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+
+	users := make([]User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		userModel, ok := userModels[userID]
+		if !ok {
+			continue
+		}
+		user, err := fillUserResponse(ctx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		users = append(users, user)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if wantsEmbeddedIcon(c) {
+		embedded := make([]*User, len(users))
+		for i := range users {
+			embedded[i] = &users[i]
+		}
+		if err := embedUserIcons(embedded); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// 自分のサブドメインがisudnsで名前解決できるか確認するAPI
+// GET /api/user/me/dns/status
+func getMyDNSStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := currentUserID(c)
+	if err != nil {
+		return err
+	}
+
+	userModel, err := getUserWithCache(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	name := userModel.Name + ".u.isucon.dev"
+	resolved, err := lookupIsuDNS(ctx, name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to query isudns: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &DNSStatus{
+		Name:     name,
+		Resolved: resolved,
+	})
+}
+
+// isudnsに直接問い合わせて、hostのAレコードが存在するかを返す
+func lookupIsuDNS(ctx context.Context, host string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, isuDNSLookupTimeout)
+	defer cancel()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "udp", net.JoinHostPort(isuDNSServerAddress, isuDNSPort))
+		},
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(addrs) > 0, nil
+}
+
+// ユーザ詳細API (ID指定)
+// GET /api/user/id/:user_id
+func getUserByIDHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id in path must be integer")
+	}
+
+	userModel, err := getUserWithCache(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	user, err := fillUserResponse(ctx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+	if wantsEmbeddedIcon(c) {
+		if err := embedUserIcons([]*User{&user}); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
 func verifyUserSession(c echo.Context) error {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
@@ -511,14 +968,39 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
 
+	// 型が想定と異なる場合もpanicさせず、未認証として扱う
+	expiresAt, ok := sessionExpires.(int64)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid EXPIRES value in session")
+	}
+
 	now := time.Now()
-	if now.Unix() > sessionExpires.(int64) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+	if now.Unix() > expiresAt {
+		return newCodedHTTPError(http.StatusUnauthorized, errCodeSessionExpired, "session has expired")
 	}
 
 	return nil
 }
 
+// セッションを検証し、ログイン中のユーザIDを返す
+func currentUserID(c echo.Context) (int64, error) {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return 0, err
+	}
+
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
+	}
+
+	return userID, nil
+}
+
 func fillUserResponse(ctx context.Context, userModel *UserModel) (User, error) {
 	user := User{
 		ID:          userModel.ID,
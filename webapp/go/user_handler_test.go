@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ログインできるユーザをキャッシュに用意する
+func cacheLoginUserForTest(t testing.TB, id int64, name, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptDefaultCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheUserForTest(&UserModel{ID: id, Name: name, HashedPassword: string(hash)})
+}
+
+// 本番と同じCookieストアでログインし、レスポンスを返す
+func loginForTest(t testing.TB, name, password string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	c, rec := newTestContext(http.MethodPost, "/api/login", strings.NewReader(`{"username":"`+name+`","password":"`+password+`"}`))
+	c.Set("_session_store", sessions.NewCookieStore(secret))
+	return rec, loginHandler(c)
+}
+
+func sessionCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == defaultSessionIDKey {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func setCookieDomain(t *testing.T, domain string) {
+	prev := cookieDomain
+	cookieDomain = domain
+	t.Cleanup(func() { cookieDomain = prev })
+}
+
+func TestLoginSessionCookieDomain(t *testing.T) {
+	for _, domain := range []string{"u.isucon.dev", "isupipe.example.test"} {
+		t.Run(domain, func(t *testing.T) {
+			setupMockDB(t)
+			setCookieDomain(t, domain)
+			cacheLoginUserForTest(t, 1, "alice", "password")
+
+			rec, err := loginForTest(t, "alice", "password")
+			if got := statusOf(err, rec); got != http.StatusOK {
+				t.Fatalf("status = %d, want %d", got, http.StatusOK)
+			}
+			cookie := sessionCookie(rec)
+			if cookie == nil {
+				t.Fatal("session cookie is not set")
+			}
+			if cookie.Domain != domain {
+				t.Errorf("cookie domain = %q, want %q", cookie.Domain, domain)
+			}
+		})
+	}
+}
+
+// resolved に含まれる名前にだけAレコードを返すスタブのisudns
+func startStubIsuDNS(t *testing.T, resolved ...string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeNameError})
+			found := false
+			for _, name := range resolved {
+				if strings.EqualFold(q.Name.String(), name+".") {
+					found = true
+				}
+			}
+			if found {
+				b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+			}
+			b.EnableCompression()
+			b.StartQuestions()
+			b.Question(q)
+			if found && q.Type == dnsmessage.TypeA {
+				b.StartAnswers()
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(msg, addr)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	prevAddr, prevPort := isuDNSServerAddress, isuDNSPort
+	isuDNSServerAddress, isuDNSPort = host, port
+	t.Cleanup(func() { isuDNSServerAddress, isuDNSPort = prevAddr, prevPort })
+}
+
+func TestGetMyDNSStatus(t *testing.T) {
+	setupMockDB(t)
+	startStubIsuDNS(t, "alice.u.isucon.dev")
+
+	tests := []struct {
+		name     string
+		user     UserModel
+		resolved bool
+	}{
+		{"resolved", UserModel{ID: 1, Name: "alice"}, true},
+		{"unresolved", UserModel{ID: 2, Name: "bob"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheUserForTest(&tt.user)
+			c, rec := newTestContext(http.MethodGet, "/api/user/me/dns/status", nil)
+			withLoginSession(c, tt.user.ID, tt.user.Name)
+
+			err := getMyDNSStatusHandler(c)
+			if status := statusOf(err, rec); status != http.StatusOK {
+				t.Fatalf("status = %d, want %d (%v)", status, http.StatusOK, err)
+			}
+			var got DNSStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := DNSStatus{Name: tt.user.Name + ".u.isucon.dev", Resolved: tt.resolved}
+			if got != want {
+				t.Errorf("response = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// アイコンの保存先を一時ディレクトリにする
+func setIconDir(t *testing.T) string {
+	dir := t.TempDir()
+	prev := iconDir
+	iconDir = dir
+	t.Cleanup(func() { iconDir = prev })
+	return dir
+}
+
+func TestPostIconLocation(t *testing.T) {
+	mock := setupMockDB(t)
+	dir := setIconDir(t)
+	cacheUserForTest(&UserModel{ID: 1, Name: "alice"})
+
+	image := []byte("icon image")
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET icon_hash = ? WHERE id = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body, err := json.Marshal(&PostIconRequest{Image: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/icon", bytes.NewReader(body))
+	withLoginSession(c, 1, "alice")
+	if got := statusOf(postIconHandler(c), rec); got != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", got, http.StatusCreated)
+	}
+	if got, want := rec.Header().Get(echo.HeaderLocation), "/api/user/alice/icon"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	hash := sha256.Sum256(image)
+	if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%x", hash))); err != nil {
+		t.Errorf("icon was not saved: %v", err)
+	}
+}
+
+func setLoginResponseWithExpiry(t *testing.T, v bool) {
+	prev := loginResponseWithExpiry
+	loginResponseWithExpiry = v
+	t.Cleanup(func() { loginResponseWithExpiry = prev })
+}
+
+func TestLoginResponseExpiry(t *testing.T) {
+	setupMockDB(t)
+	setLoginResponseWithExpiry(t, true)
+	cacheLoginUserForTest(t, 1, "alice", "password")
+
+	before := time.Now()
+	rec, err := loginForTest(t, "alice", "password")
+	if got := statusOf(err, rec); got != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%v)", got, http.StatusOK, err)
+	}
+	var res LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.User.ID != 1 || res.User.Name != "alice" {
+		t.Errorf("user = %+v, want alice", res.User)
+	}
+
+	cookie := sessionCookie(rec)
+	if cookie == nil {
+		t.Fatal("session cookie is not set")
+	}
+	// レスポンスの有効期限とCookieの寿命が一致する
+	if cookie.MaxAge != int(sessionDuration.Seconds()) {
+		t.Errorf("cookie MaxAge = %d, want %d", cookie.MaxAge, int(sessionDuration.Seconds()))
+	}
+	if d := res.ExpiresAt - cookie.Expires.Unix(); d < -1 || d > 1 {
+		t.Errorf("expires_at = %d, cookie expires = %d", res.ExpiresAt, cookie.Expires.Unix())
+	}
+	if want := before.Add(sessionDuration).Unix(); res.ExpiresAt < want {
+		t.Errorf("expires_at = %d, want >= %d", res.ExpiresAt, want)
+	}
+}
+
+func TestLoginResponseWithoutExpiry(t *testing.T) {
+	setupMockDB(t)
+	setLoginResponseWithExpiry(t, false)
+	cacheLoginUserForTest(t, 1, "alice", "password")
+
+	rec, err := loginForTest(t, "alice", "password")
+	if got := statusOf(err, rec); got != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%v)", got, http.StatusOK, err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("body = %q, want empty", rec.Body.String())
+	}
+}
+
+// キャッシュが切れた直後に同じユーザへのリクエストが集中しても、DBを引くのは1回だけ
+// 共有した結果の読み書きも含めて go test -race で確認する
+func TestGetUserDeduplicatesConcurrentLoads(t *testing.T) {
+	const concurrency = 50
+	cases := []struct {
+		name  string
+		query string
+		arg   interface{}
+		load  func(ctx context.Context) (*UserModel, error)
+	}{
+		{"by id", "FROM users WHERE id = ?", 1, func(ctx context.Context) (*UserModel, error) { return getUserWithCache(ctx, 1) }},
+		{"by name", "FROM users WHERE name = ?", "alice", func(ctx context.Context) (*UserModel, error) { return getUserByName(ctx, "alice") }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			// 2回目のクエリはsqlmockがエラーを返す
+			mock.ExpectQuery(regexp.QuoteMeta(tc.query)).
+				WithArgs(tc.arg).
+				WillDelayFor(50 * time.Millisecond).
+				WillReturnRows(userRows(UserModel{ID: 1, Name: "alice", IconHash: []byte("hash")}))
+
+			ctx := context.Background()
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			errs := make(chan error, concurrency)
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					u, err := tc.load(ctx)
+					if err == nil && (u.ID != 1 || u.Name != "alice" || string(u.IconHash) != "hash") {
+						err = fmt.Errorf("unexpected user: %+v", u)
+					}
+					errs <- err
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// 最初にDBを引き始めたリクエストがキャンセルされても、相乗りしたリクエストには結果が届く
+func TestGetUserSharedLoadSurvivesFirstCallerCancel(t *testing.T) {
+	mock := setupMockDB(t)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillDelayFor(100 * time.Millisecond).
+		WillReturnRows(userRows(UserModel{ID: 1, Name: "alice", IconHash: []byte("hash")}))
+
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := getUserWithCache(firstCtx, 1)
+		firstErr <- err
+	}()
+	// 最初のリクエストの読み込みが始まってから相乗りする
+	time.Sleep(20 * time.Millisecond)
+	type result struct {
+		user *UserModel
+		err  error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		u, err := getUserWithCache(context.Background(), 1)
+		waiter <- result{u, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("first caller error = %v, want %v", err, context.Canceled)
+	}
+	res := <-waiter
+	if res.err != nil {
+		t.Fatalf("waiter error = %v", res.err)
+	}
+	if res.user.ID != 1 || res.user.Name != "alice" {
+		t.Errorf("waiter user = %+v, want alice", res.user)
+	}
+}
+
+func TestIconCacheTTL(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"unset", "", defaultIconCacheTTL},
+		{"custom", "2500", 2500 * time.Millisecond},
+		{"zero", "0", defaultIconCacheTTL},
+		{"invalid", "abc", defaultIconCacheTTL},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.value != "" {
+				t.Setenv(iconCacheTTLEnvKey, tc.value)
+			}
+			if got := iconCacheTTL(); got != tc.want {
+				t.Errorf("iconCacheTTL() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// アイコンを更新したら、キャッシュの期限を待たずに新しいハッシュを返す
+func TestPostIconInvalidatesIconCache(t *testing.T) {
+	mock := setupMockDB(t)
+	setIconDir(t)
+	ctx := context.Background()
+	cacheUserForTest(&UserModel{ID: 1, Name: "alice", IconHash: []byte("old")})
+
+	image := []byte("new icon")
+	newHash := sha256.Sum256(image)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET icon_hash = ? WHERE id = ?")).
+		WithArgs(newHash[:], 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(userRows(UserModel{ID: 1, Name: "alice", IconHash: newHash[:]}))
+
+	body, err := json.Marshal(&PostIconRequest{Image: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, rec := newTestContext(http.MethodPost, "/api/icon", bytes.NewReader(body))
+	withLoginSession(c, 1, "alice")
+	if got := statusOf(postIconHandler(c), rec); got != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", got, http.StatusCreated)
+	}
+	if _, found := iconCache.Get("alice"); found {
+		t.Error("icon cache of alice was not invalidated")
+	}
+
+	user, err := getUserWithCache(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(user.IconHash, newHash[:]) {
+		t.Errorf("icon hash = %x, want %x", user.IconHash, newHash)
+	}
+}
+
+// ユーザ名として使えない名前は、DBやisudnsに触れる前に400で弾く
+func TestRegisterInvalidUsername(t *testing.T) {
+	cases := []struct {
+		name     string
+		username string
+	}{
+		{"empty", ""},
+		{"dot", "alice.bob"},
+		{"underscore", "alice_bob"},
+		{"uppercase", "Alice"},
+		{"non ascii", "ありす"},
+		{"too long", strings.Repeat("a", 64)},
+		{"leading hyphen", "-alice"},
+		{"trailing hyphen", "alice-"},
+		{"reserved pipe", "pipe"},
+		{"reserved ns1", "ns1"},
+		{"reserved www", "www"},
+		{"reserved id", "id"},
+		{"reserved search", "search"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// 期待するクエリはない
+			setupMockDB(t)
+			body, err := json.Marshal(&PostUserRequest{Name: tc.username, DisplayName: "display", Password: "password"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, rec := newTestContext(http.MethodPost, "/api/register", bytes.NewReader(body))
+			if got := statusOf(registerHandler(c), rec); got != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", got, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestUsernamePatternAcceptsDNSLabels(t *testing.T) {
+	for _, name := range []string{"a", "alice", "alice-bob", "0123", strings.Repeat("a", 63)} {
+		if !usernamePattern.MatchString(name) {
+			t.Errorf("%q should be a valid username", name)
+		}
+	}
+}
+
+// isudnsのレコードAPIへのリクエストを記録するスタブ
+func startStubIsuDNSAPI(t *testing.T) func() []string {
+	t.Helper()
+	var (
+		mtx      sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var param struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mtx.Lock()
+		requests = append(requests, r.Method+" "+param.Username)
+		mtx.Unlock()
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	prevAddr, prevPort := isuDNSServerAddress, isuDNSAPIPort
+	isuDNSServerAddress, isuDNSAPIPort = host, port
+	t.Cleanup(func() { isuDNSServerAddress, isuDNSAPIPort = prevAddr, prevPort })
+	return func() []string {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestRegisterRollsBackIsuDNSRecord(t *testing.T) {
+	cases := []struct {
+		name      string
+		commitErr error
+		status    int
+		requests  []string
+	}{
+		{"committed", nil, http.StatusCreated, []string{"POST alice"}},
+		{"commit failed", errors.New("commit failed"), http.StatusInternalServerError, []string{"POST alice", "DELETE alice"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			requests := startStubIsuDNSAPI(t)
+
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO themes")).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit().WillReturnError(tc.commitErr)
+
+			body, err := json.Marshal(&PostUserRequest{Name: "alice", DisplayName: "Alice", Password: "password"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, rec := newTestContext(http.MethodPost, "/api/register", bytes.NewReader(body))
+			if got := statusOf(registerHandler(c), rec); got != tc.status {
+				t.Errorf("status = %d, want %d", got, tc.status)
+			}
+			// コミットに失敗したらレコードを消して、孤立したレコードを残さない
+			if got := requests(); !reflect.DeepEqual(got, tc.requests) {
+				t.Errorf("isudns requests = %v, want %v", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestRegisterDuplicateUsername(t *testing.T) {
+	cases := []struct {
+		name      string
+		insertErr error
+		status    int
+	}{
+		{"duplicate", &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry 'alice' for key 'users.uniq_user_name'"}, http.StatusConflict},
+		{"other error", &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := setupMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
+				WillReturnError(tc.insertErr)
+			mock.ExpectRollback()
+
+			body, err := json.Marshal(&PostUserRequest{Name: "alice", DisplayName: "Alice", Password: "password"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, rec := newTestContext(http.MethodPost, "/api/register", bytes.NewReader(body))
+			err = registerHandler(c)
+			if got := statusOf(err, rec); got != tc.status {
+				t.Errorf("status = %d, want %d", got, tc.status)
+			}
+			if _, code := resolveErrorCode(err); tc.status == http.StatusConflict && code != errCodeUsernameTaken {
+				t.Errorf("code = %s, want %s", code, errCodeUsernameTaken)
+			}
+		})
+	}
+}
+
+// 実際のMySQLで同じ名前を2回登録する
+func TestRegisterSameNameTwice(t *testing.T) {
+	setupTestMySQL(t)
+	startStubIsuDNSAPI(t)
+
+	var statuses []int
+	for i := 0; i < 2; i++ {
+		body, err := json.Marshal(&PostUserRequest{Name: "alice", DisplayName: "Alice", Password: "password"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, rec := newTestContext(http.MethodPost, "/api/register", bytes.NewReader(body))
+		statuses = append(statuses, statusOf(registerHandler(c), rec))
+	}
+	if want := []int{http.StatusCreated, http.StatusConflict}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+}
+
+// キャッシュ済みのユーザのログインでDBの接続を使わないことを確かめる
+// 以前はbcryptの比較の間もトランザクションで接続を1本掴んでいた
+//
+//	go test -run '^$' -bench BenchmarkLogin -benchmem
+func BenchmarkLogin(b *testing.B) {
+	// ログインのクエリは期待しないので、DBを使えばsqlmockがエラーを返す
+	setupMockDB(b)
+	dbConn.SetMaxOpenConns(1)
+	cacheLoginUserForTest(b, 1, "alice", "password")
+	before := dbConn.Stats()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec, err := loginForTest(b, "alice", "password")
+			if status := statusOf(err, rec); status != http.StatusOK {
+				b.Errorf("status = %d, want %d (%v)", status, http.StatusOK, err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	// sqlmockはPingで接続を1本開いているので、その分を差し引く
+	after := dbConn.Stats()
+	b.ReportMetric(float64(after.OpenConnections-before.OpenConnections), "db-conns-opened")
+	b.ReportMetric(float64(after.WaitCount-before.WaitCount), "db-waits")
+}
+
+// セッションの値の型が想定と違っても、panicせずに401を返す
+func TestMalformedSessionValues(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+	cases := []struct {
+		name   string
+		values map[interface{}]interface{}
+	}{
+		{"user id as string", map[interface{}]interface{}{defaultUserIDKey: "1", defaultSessionExpiresKey: expires}},
+		{"user id as int", map[interface{}]interface{}{defaultUserIDKey: 1, defaultSessionExpiresKey: expires}},
+		{"user id missing", map[interface{}]interface{}{defaultSessionExpiresKey: expires}},
+		{"expires as string", map[interface{}]interface{}{defaultUserIDKey: int64(1), defaultSessionExpiresKey: "tomorrow"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// DBは引かない
+			setupMockDB(t)
+			c, rec := newTestContext(http.MethodGet, "/api/user/me", nil)
+			c.Set("_session_store", &testSessionStore{values: tc.values})
+			if got := statusOf(getMeHandler(c), rec); got != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", got, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func setLoginMaxFailuresPerIP(t *testing.T, n int) {
+	prev := loginFailuresByIP.maxFailures
+	loginFailuresByIP.maxFailures = n
+	t.Cleanup(func() { loginFailuresByIP.maxFailures = prev })
+}
+
+// 自分のアカウントへのログインを挟んでも、IPごとの失敗回数は戻らない
+func TestLoginSuccessKeepsIPFailures(t *testing.T) {
+	setupMockDB(t)
+	setLoginMaxFailuresPerIP(t, 2)
+	cacheLoginUserForTest(t, 1, "alice", "password")
+	cacheLoginUserForTest(t, 2, "mallory", "password")
+
+	attempts := []struct {
+		name, password string
+		want           int
+	}{
+		{"alice", "guess1", http.StatusUnauthorized},
+		{"mallory", "password", http.StatusOK},
+		{"alice", "guess2", http.StatusUnauthorized},
+		{"alice", "password", http.StatusTooManyRequests},
+	}
+	for i, a := range attempts {
+		rec, err := loginForTest(t, a.name, a.password)
+		if got := statusOf(err, rec); got != a.want {
+			t.Fatalf("attempt %d (%s): status = %d, want %d", i, a.name, got, a.want)
+		}
+	}
+}
@@ -11,6 +11,7 @@ TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
 TRUNCATE TABLE favorite_emojis;
+TRUNCATE TABLE reservation_idempotency_keys;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
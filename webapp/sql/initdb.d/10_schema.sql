@@ -8,7 +8,8 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
-  UNIQUE `uniq_user_name` (`name`)
+  UNIQUE `uniq_user_name` (`name`),
+  INDEX `idx_display_name` (`display_name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin ;
 
 -- プロフィール画像
@@ -77,7 +78,16 @@ CREATE TABLE `livestream_viewers_history` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  -- 最後に入室した時刻
+  `created_at` BIGINT NOT NULL,
+  -- 退室した時刻 (視聴中はNULL)
+  `ended_at` BIGINT NULL DEFAULT NULL,
+  -- 終了した視聴セッションの累計視聴秒数
+  `watch_seconds` BIGINT NOT NULL DEFAULT 0,
+  -- 最後に入室またはハートビートを受け取った時刻
+  `updated_at` BIGINT NOT NULL DEFAULT 0,
+  -- 再入室しても視聴者数が増えないよう、ユーザとライブ配信の組で1行にする
+  UNIQUE `uniq_user_livestream` (`user_id`, `livestream_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信に対するライブコメント
@@ -99,7 +109,11 @@ CREATE TABLE `livecomment_reports` (
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `livecomment_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  -- spam, harassment, other
+  `reason` VARCHAR(32) NOT NULL DEFAULT 'other',
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_livecomment` (`user_id`, `livecomment_id`),
+  INDEX `idx_livestream_reason` (`livestream_id`, `reason`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- 配信者からのNGワード登録
@@ -109,8 +123,11 @@ CREATE TABLE `ng_words` (
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `word` VARCHAR(255) NOT NULL,
+  -- 投稿を拒否した数とmoderate時に削除した数の合計
+  `blocked_count` BIGINT NOT NULL DEFAULT 0,
   `created_at` BIGINT NOT NULL,
-  INDEX `idx_ng_word` (`livestream_id`, `user_id`)
+  INDEX `idx_ng_word` (`livestream_id`, `user_id`),
+  UNIQUE `uniq_livestream_word` (`livestream_id`, `word`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX ng_words_word ON ng_words(`word`);
 
@@ -123,13 +140,26 @@ CREATE TABLE `reactions` (
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
   `created_at` BIGINT NOT NULL,
-  INDEX `idx_reaction` (`livestream_id`, `created_at` DESC)
+  INDEX `idx_reaction` (`livestream_id`, `created_at` DESC),
+  INDEX `idx_created_at` (`created_at`),
+  INDEX `idx_user_id` (`user_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 
+-- 予約APIの冪等性キー
+DROP TABLE IF EXISTS `reservation_idempotency_keys`;
+CREATE TABLE `reservation_idempotency_keys` (
+  `user_id` BIGINT NOT NULL,
+  `idempotency_key` VARCHAR(255) NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`user_id`, `idempotency_key`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 DROP TABLE IF EXISTS `favorite_emojis`;
 CREATE TABLE `favorite_emojis` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `emoji_name` VARCHAR(255) NOT NULL
+  `emoji_name` VARCHAR(255) NOT NULL,
+  INDEX `idx_user_emoji` (`user_id`, `emoji_name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;